@@ -0,0 +1,435 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+
+//
+
+// roachclip runs maintenance jobs against a roachclip-fs store:
+//
+//	roachclip [-roachhost host] [-roachport port] -keys keys.json rotate [-full]
+//	roachclip [-roachhost host] [-roachport port] compact [-garbage 0.5]
+//	roachclip [-roachhost host] [-roachport port] [-keys keys.json] repair [-id id]
+//	roachclip [-roachhost host] [-roachport port] [-keys keys.json] -tier name=dir move -id id [-to name]
+//	roachclip [-roachhost host] [-roachport port] -tier name=dir collect
+//	roachclip [-roachhost host] [-roachport port] [-keys keys.json] [-tier name=dir] lifecycle -rules rules.json [-dry-run]
+//	roachclip [-roachhost host] [-roachport port] sweep
+//	roachclip [-roachhost host] [-roachport port] [-tier name=dir] purge [-days 30] [-id id]
+//	roachclip [-roachhost host] [-roachport port] restore -id id
+//	roachclip [-roachhost host] [-roachport port] lock -id id -days days
+//	roachclip [-roachhost host] [-roachport port] hold -id id
+//	roachclip [-roachhost host] [-roachport port] release -id id -custodian secret
+//	roachclip [-roachhost host] [-roachport port] custodian [-current secret] -new secret
+//	roachclip [-roachhost host] [-roachport port] audit [-days 1] [-id id]
+//
+// Every command takes -tenant to act on a tenant other than the default
+// one.
+//
+// The keys file holds the master keys as JSON, base64 encoded, with the
+// one to wrap data keys with named as current:
+//
+//	{"current": "2016", "keys": {"2015": "...", "2016": "..."}}
+//
+// The tier flag registers a directory tier of the given name. The rules
+// file holds a JSON list of lifecycle rules:
+//
+//	[{"prefix": "logs/", "days": 365, "action": "expire"},
+//	 {"mimeType": "video/", "size": 67108864, "action": "tier", "tier": "cold"}]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/roachclip-fs/mode"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// options are those given by the flags
+var options mode.Options
+
+// tenant is the tenant the command acts on, the default one unless -tenant
+// is given
+var tenant *mode.Tenant
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: roachclip [flags] <command> [command flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	fmt.Fprintln(os.Stderr, "  rotate    re-wrap every data key with the current master key")
+	fmt.Fprintln(os.Stderr, "  compact   rewrite packs holding mostly deleted files")
+	fmt.Fprintln(os.Stderr, "  repair    rebuild lost or damaged chunks of erasure coded files")
+	fmt.Fprintln(os.Stderr, "  move      move a file's chunks to another tier")
+	fmt.Fprintln(os.Stderr, "  collect   delete chunks released from tiers")
+	fmt.Fprintln(os.Stderr, "  lifecycle expire, compress or tier files by rule")
+	fmt.Fprintln(os.Stderr, "  sweep     destroy expired files")
+	fmt.Fprintln(os.Stderr, "  purge     destroy files that have been in the trash for some days")
+	fmt.Fprintln(os.Stderr, "  restore   take a file out of the trash")
+	fmt.Fprintln(os.Stderr, "  lock      keep a file as it is for some days")
+	fmt.Fprintln(os.Stderr, "  hold      place a legal hold on a file")
+	fmt.Fprintln(os.Stderr, "  release   lift the lock and legal hold of a file")
+	fmt.Fprintln(os.Stderr, "  custodian set the secret that releases locks")
+	fmt.Fprintln(os.Stderr, "  audit     show who did what to files")
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// loadKeys reads the master keys from the named file
+func loadKeys(name string) (*mode.MasterKeys, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := &mode.MasterKeys{}
+	if err := json.NewDecoder(f).Decode(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// rotate re-wraps or, with -full, re-encrypts every primitive. Run it
+// again after an interruption to resume.
+func rotate(args []string) {
+	flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+	full := flags.Bool("full", false, "also re-encrypt the chunks under new data keys")
+	flags.Parse(args)
+
+	job, err := tenant.RotateKeys(*full)
+	if job != nil {
+		fmt.Printf("master key %s: %d re-wrapped, %d re-encrypted\n", job.KeyId, job.Rewrapped, job.Reencrypted)
+	}
+	if err != nil {
+		log.Fatal("rotate: ", err, " (run again to resume)")
+	}
+}
+
+// compact rewrites the packs that are at least -garbage deleted
+func compact(args []string) {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	garbage := flags.Float64("garbage", 0.5, "fraction of a pack deleted before it is rewritten")
+	flags.Parse(args)
+
+	n, err := tenant.CompactPacks(*garbage)
+	fmt.Printf("%d packs rewritten\n", n)
+	if err != nil {
+		log.Fatal("compact: ", err)
+	}
+}
+
+// repair rebuilds the lost chunks of one primitive, or of all of them
+func repair(args []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	id := flags.String("id", "", "repair just the primitive with this id")
+	flags.Parse(args)
+
+	var n int
+	var err error
+	if *id != "" {
+		n, err = (&mode.Primitive{Id: *id, Tenant: tenant.Name}).Repair()
+	} else {
+		n, err = tenant.RepairAll()
+	}
+	fmt.Printf("%d chunks rewritten\n", n)
+	if err != nil {
+		log.Fatal("repair: ", err)
+	}
+}
+
+// move moves the chunks of a primitive to the tier named by -to, or
+// into cockroach if it is empty
+func move(args []string) {
+	flags := flag.NewFlagSet("move", flag.ExitOnError)
+	id := flags.String("id", "", "the primitive to move")
+	to := flags.String("to", "", "the tier to move it to, empty for cockroach")
+	flags.Parse(args)
+	if *id == "" {
+		usage()
+	}
+
+	if err := (&mode.Primitive{Id: *id, Tenant: tenant.Name}).MoveTier(*to); err != nil {
+		log.Fatal("move: ", err)
+	}
+}
+
+// collect deletes the chunks released from tiers
+func collect(args []string) {
+	n, err := tenant.CollectTiers()
+	fmt.Printf("%d chunks deleted\n", n)
+	if err != nil {
+		log.Fatal("collect: ", err)
+	}
+}
+
+// lifecycle applies the rules in the -rules file, printing each action
+func lifecycle(args []string) {
+	flags := flag.NewFlagSet("lifecycle", flag.ExitOnError)
+	name := flags.String("rules", "", "file holding the lifecycle rules")
+	dryRun := flags.Bool("dry-run", false, "print the actions without taking them")
+	flags.Parse(args)
+	if *name == "" {
+		usage()
+	}
+
+	f, err := os.Open(*name)
+	if err != nil {
+		log.Fatal("rules: ", err)
+	}
+	var rules []mode.Rule
+	err = json.NewDecoder(f).Decode(&rules)
+	f.Close()
+	if err != nil {
+		log.Fatal("rules: ", err)
+	}
+	actions, err := tenant.RunLifecycle(rules, *dryRun)
+	for _, action := range actions {
+		fmt.Printf("%s %s %s (rule %d)\n", action.Action, action.Id, action.Name, action.Rule)
+	}
+	if err != nil {
+		log.Fatal("lifecycle: ", err)
+	}
+}
+
+// sweep destroys the primitives that have expired
+func sweep(args []string) {
+	n, err := tenant.SweepExpired()
+	fmt.Printf("%d files destroyed\n", n)
+	if err != nil {
+		log.Fatal("sweep: ", err)
+	}
+}
+
+// purge destroys the primitives in the trash for at least -days, or just
+// the one with -id, in the trash or not
+func purge(args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	days := flags.Int("days", 30, "days a file must have been in the trash")
+	id := flags.String("id", "", "purge just the primitive with this id")
+	flags.Parse(args)
+
+	if *id != "" {
+		if err := (&mode.Primitive{Id: *id, Tenant: tenant.Name}).Purge(); err != nil {
+			log.Fatal("purge: ", err)
+		}
+		return
+	}
+	options.TrashDays = *days
+	if err := tenant.SetOptions(options); err != nil {
+		log.Fatal(err)
+	}
+	n, err := tenant.PurgeTrash()
+	fmt.Printf("%d files destroyed\n", n)
+	if err != nil {
+		log.Fatal("purge: ", err)
+	}
+}
+
+// restore takes a primitive out of the trash
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	id := flags.String("id", "", "the primitive to restore")
+	flags.Parse(args)
+	if *id == "" {
+		usage()
+	}
+
+	if err := (&mode.Primitive{Id: *id, Tenant: tenant.Name}).Restore(); err != nil {
+		log.Fatal("restore: ", err)
+	}
+}
+
+// lock keeps a primitive as it is for -days
+func lock(args []string) {
+	flags := flag.NewFlagSet("lock", flag.ExitOnError)
+	id := flags.String("id", "", "the primitive to lock")
+	days := flags.Int("days", 0, "days to keep it as it is")
+	flags.Parse(args)
+	if *id == "" || *days <= 0 {
+		usage()
+	}
+
+	until := time.Now().Add(time.Duration(*days) * 24 * time.Hour)
+	if err := (&mode.Primitive{Id: *id, Tenant: tenant.Name}).Lock(until); err != nil {
+		log.Fatal("lock: ", err)
+	}
+}
+
+// hold places a legal hold on a primitive
+func hold(args []string) {
+	flags := flag.NewFlagSet("hold", flag.ExitOnError)
+	id := flags.String("id", "", "the primitive to hold")
+	flags.Parse(args)
+	if *id == "" {
+		usage()
+	}
+
+	if err := (&mode.Primitive{Id: *id, Tenant: tenant.Name}).PlaceHold(); err != nil {
+		log.Fatal("hold: ", err)
+	}
+}
+
+// release lifts the lock and legal hold of a primitive, given the
+// custodian secret
+func release(args []string) {
+	flags := flag.NewFlagSet("release", flag.ExitOnError)
+	id := flags.String("id", "", "the primitive to release")
+	secret := flags.String("custodian", "", "the custodian secret")
+	flags.Parse(args)
+	if *id == "" {
+		usage()
+	}
+
+	if err := (&mode.Primitive{Id: *id, Tenant: tenant.Name}).Release(*secret); err != nil {
+		log.Fatal("release: ", err)
+	}
+}
+
+// custodian sets the custodian secret, given the current one if there is
+func custodian(args []string) {
+	flags := flag.NewFlagSet("custodian", flag.ExitOnError)
+	current := flags.String("current", "", "the current custodian secret, if one is set")
+	next := flags.String("new", "", "the new custodian secret")
+	flags.Parse(args)
+	if *next == "" {
+		usage()
+	}
+
+	if err := tenant.SetCustodian(*current, *next); err != nil {
+		log.Fatal("custodian: ", err)
+	}
+}
+
+// audit prints the audit records of the last -days, of every primitive
+// or just the one with -id
+func audit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	id := flags.String("id", "", "show just the records of the primitive with this id")
+	days := flags.Int("days", 1, "days to go back")
+	flags.Parse(args)
+
+	to := time.Now()
+	from := to.Add(-time.Duration(*days) * 24 * time.Hour)
+	var records []mode.AuditRecord
+	var err error
+	if *id != "" {
+		records, err = tenant.ReadAuditOf(*id, from, to, 1000)
+	} else {
+		records, err = tenant.ReadAudit(from, to, 1000)
+	}
+	for {
+		if err != nil {
+			log.Fatal("audit: ", err)
+		}
+		for _, r := range records {
+			fmt.Printf("%s\t%s\t%s\t%s\t%d\t%s\n", r.Time, r.Actor, r.Op, r.Id, r.Bytes, r.Result)
+		}
+		if len(records) < 1000 {
+			return
+		}
+		// the next page starts right after the last record, even one
+		// made in the same nanosecond
+		records, err = tenant.ReadAuditAfter(*id, records[len(records)-1].Seq, to, 1000)
+	}
+}
+
+func main() {
+	hostname := flag.String("roachhost", "localhost", "a valid ip address")
+	portnumber := flag.Int("roachport", 8080, "a valid port name")
+	keyfile := flag.String("keys", "", "file holding the master keys")
+	tier := flag.String("tier", "", "name=dir of a directory tier")
+	tenantname := flag.String("tenant", "", "the tenant to act on, the default one if empty")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	var err error
+	if *tenantname != "" {
+		tenant, err = mode.RegisterTenant(*tenantname, options)
+	} else {
+		tenant, err = mode.LookupTenant("")
+	}
+	if err != nil {
+		log.Fatal("tenant: ", err)
+	}
+
+	if *keyfile != "" {
+		keys, err := loadKeys(*keyfile)
+		if err != nil {
+			log.Fatal("keys: ", err)
+		}
+		options.Keys = keys
+		if err := tenant.SetOptions(options); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *tier != "" {
+		i := strings.Index(*tier, "=")
+		if i < 1 {
+			usage()
+		}
+		t, err := mode.NewDirTier((*tier)[:i], (*tier)[i+1:])
+		if err != nil {
+			log.Fatal("tier: ", err)
+		}
+		mode.RegisterTier(t)
+	}
+	mode.OpenRoach(*hostname, *portnumber)
+	defer mode.CloseRoach()
+
+	switch flag.Arg(0) {
+	case "rotate":
+		rotate(flag.Args()[1:])
+	case "compact":
+		compact(flag.Args()[1:])
+	case "repair":
+		repair(flag.Args()[1:])
+	case "move":
+		move(flag.Args()[1:])
+	case "collect":
+		collect(flag.Args()[1:])
+	case "lifecycle":
+		lifecycle(flag.Args()[1:])
+	case "sweep":
+		sweep(flag.Args()[1:])
+	case "purge":
+		purge(flag.Args()[1:])
+	case "restore":
+		restore(flag.Args()[1:])
+	case "lock":
+		lock(flag.Args()[1:])
+	case "hold":
+		hold(flag.Args()[1:])
+	case "release":
+		release(flag.Args()[1:])
+	case "custodian":
+		custodian(flag.Args()[1:])
+	case "audit":
+		audit(flag.Args()[1:])
+	default:
+		usage()
+	}
+}
@@ -30,15 +30,22 @@ package main
 import (
 	//"crypto/md5"
 	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/roachclip-fs/mode"
 	"html/template"
 	//	"io"
 	"flag"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 //Compile templates on start
@@ -50,9 +57,66 @@ func display(w http.ResponseWriter, tmpl string, data interface{}) {
 }
 
 // upload logic
+// user is an account of the server
+type user struct {
+	Password string   `json:"password"` // sha256 of the password, hex encoded
+	Groups   []string `json:"groups"`
+	Tenant   string   `json:"tenant"` // tenant the user's files are in, "" for the default one
+}
+
+// users who may use the server, keyed by name, nil to let anyone use it
+var users map[string]user
+
+// identify makes the user a request is authenticated as, with HTTP basic
+// authentication, the actor of p, so the library checks the user may do
+// what is asked. Without users, requests are anonymous and go unchecked.
+// A request that isn't authenticated is answered 401, and false returned.
+// The tenant of the user is made the tenant of p; a request naming another
+// with the tenant query parameter is answered 403. Anonymous requests are
+// in the tenant the parameter names, if any.
+func identify(w http.ResponseWriter, r *http.Request, p *mode.Primitive) bool {
+	tenant, named := r.URL.Query()["tenant"]
+	if users == nil {
+		if named {
+			p.Tenant = tenant[0]
+		}
+		return true
+	}
+	name, password, ok := r.BasicAuth()
+	u, known := users[name]
+	sum := sha256.Sum256([]byte(password))
+	if !ok || !known || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(u.Password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="roachclip"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if named && tenant[0] != u.Tenant {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	p.Actor, p.Groups, p.Tenant = name, u.Groups, u.Tenant
+	return true
+}
+
+// status is the HTTP status answering err
+func status(err error) int {
+	switch err {
+	case mode.NOT_FOUND, mode.SESSION_NOT_FOUND, mode.UPLOAD_NOT_FOUND:
+		return http.StatusNotFound
+	case mode.FORBIDDEN:
+		return http.StatusForbidden
+	case mode.LOCKED:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 func upload(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("method:", r.Method)
 	if r.Method == "GET" {
+		if !identify(w, r, new(mode.Primitive)) {
+			return
+		}
 		display(w, "upload", nil)
 	} else {
 		//parse the multipart form in the request
@@ -68,6 +132,9 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		//get the *fileheaders
 		files := m.File["myfiles"]
 		p := new(mode.Primitive)
+		if !identify(w, r, p) {
+			return
+		}
 		for i, _ := range files {
 			//for each fileheader, get a handle to the actual file
 			file, err := files[i].Open()
@@ -90,6 +157,15 @@ func upload(w http.ResponseWriter, r *http.Request) {
 			p.Name = files[i].Filename
 			p.MimeType = header.Get("Content-Type")
 			p.Length = int(stat.Size())
+			// files uploaded with a ttl, in seconds, expire by themselves
+			if ttl := r.FormValue("ttl"); ttl != "" {
+				seconds, err := strconv.Atoi(ttl)
+				if err != nil || seconds <= 0 {
+					http.Error(w, "ttl must be a positive number of seconds", http.StatusBadRequest)
+					return
+				}
+				p.ExpireIn(time.Duration(seconds) * time.Second)
+			}
 
 			reader := bufio.NewReader(file)
 			err = p.Make(reader)
@@ -135,11 +211,13 @@ func download(w http.ResponseWriter, r *http.Request) {
 			w.Write(js)
 		}
 		writer := bufio.NewWriter(w)
-		p := new(mode.Primitive)
-		p.Id = id
+		p := &mode.Primitive{Id: id}
+		if !identify(w, r, p) {
+			return
+		}
 		err := p.Stream(writer)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), status(err))
 			return
 		}
 
@@ -150,20 +228,418 @@ func download(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// session logic, for uploads that can be resumed after a dropped connection
+//
+//	POST /session?name=<name>&length=<bytes>  starts a session
+//	GET  /session?id=<id>                     reports the bytes committed so far
+//	PUT  /session?id=<id>&offset=<bytes>      writes the request body at offset
+func session(w http.ResponseWriter, r *http.Request) {
+	length, _ := strconv.Atoi(r.FormValue("length"))
+	p := &mode.Primitive{Name: r.FormValue("name"), MimeType: r.Header.Get("Content-Type"), Length: length}
+	if !identify(w, r, p) {
+		return
+	}
+	var s *mode.Session
+	switch r.Method {
+	case "POST":
+		var err error
+		s, err = p.StartSession()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "GET":
+		s = &mode.Session{Id: r.FormValue("id"), Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+		if err := s.Find(); err != nil {
+			http.Error(w, err.Error(), status(err))
+			return
+		}
+	case "PUT":
+		s = &mode.Session{Id: r.FormValue("id"), Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+		offset, err := strconv.Atoi(r.FormValue("offset"))
+		if err != nil {
+			http.Error(w, "missing or invalid offset in query", http.StatusBadRequest)
+			return
+		}
+		if r.ContentLength < 0 {
+			http.Error(w, "missing Content-Length", http.StatusLengthRequired)
+			return
+		}
+		err = s.Write(bufio.NewReader(r.Body), offset, int(r.ContentLength))
+		if err == mode.WRONG_OFFSET {
+			// s holds the committed offset the client should resume from
+			w.WriteHeader(http.StatusConflict)
+		} else if err != nil {
+			http.Error(w, err.Error(), status(err))
+			return
+		}
+	default:
+		http.Error(w, "method not supported", http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(map[string]interface{}{"id": s.Id, "offset": s.Offset(), "length": s.Length})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// finalize turns a completed session into a primitive
+//
+//	POST /session/finalize?id=<id>
+func finalize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not supported", http.StatusInternalServerError)
+		return
+	}
+	who := new(mode.Primitive)
+	if !identify(w, r, who) {
+		return
+	}
+	s := &mode.Session{Id: r.FormValue("id"), Actor: who.Actor, Groups: who.Groups, Tenant: who.Tenant}
+	p, err := s.Finalize()
+	if err != nil {
+		http.Error(w, err.Error(), status(err))
+		return
+	}
+	js, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// multipart logic, for uploads sent as independent parts
+//
+//	POST   /multipart?name=<name>            starts an upload
+//	PUT    /multipart?id=<id>&part=<number>  uploads the request body as a part
+//	GET    /multipart?id=<id>                lists the parts uploaded so far
+//	DELETE /multipart?id=<id>                aborts the upload
+func multipart(w http.ResponseWriter, r *http.Request) {
+	p := &mode.Primitive{Name: r.FormValue("name"), MimeType: r.Header.Get("Content-Type")}
+	if !identify(w, r, p) {
+		return
+	}
+	var result interface{}
+	m := &mode.Multipart{Id: r.FormValue("id"), Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+	var err error
+	switch r.Method {
+	case "POST":
+		result, err = p.StartMultipart()
+	case "PUT":
+		number, e := strconv.Atoi(r.FormValue("part"))
+		if e != nil {
+			http.Error(w, "missing or invalid part in query", http.StatusBadRequest)
+			return
+		}
+		if r.ContentLength < 0 {
+			http.Error(w, "missing Content-Length", http.StatusLengthRequired)
+			return
+		}
+		result, err = m.UploadPart(number, bufio.NewReader(r.Body), int(r.ContentLength))
+	case "GET":
+		result, err = m.ListParts()
+	case "DELETE":
+		err = m.Abort()
+		result = map[string]string{"success": "true"}
+	default:
+		http.Error(w, "method not supported", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status(err))
+		return
+	}
+	js, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// complete turns the listed parts of a multipart upload into a primitive
+//
+//	POST /multipart/complete?id=<id>&parts=1,2,3
+func complete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not supported", http.StatusInternalServerError)
+		return
+	}
+	who := new(mode.Primitive)
+	if !identify(w, r, who) {
+		return
+	}
+	var numbers []int
+	for _, s := range strings.Split(r.FormValue("parts"), ",") {
+		number, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "missing or invalid parts in query", http.StatusBadRequest)
+			return
+		}
+		numbers = append(numbers, number)
+	}
+	m := &mode.Multipart{Id: r.FormValue("id"), Actor: who.Actor, Groups: who.Groups, Tenant: who.Tenant}
+	p, err := m.Complete(numbers)
+	if err != nil {
+		http.Error(w, err.Error(), status(err))
+		return
+	}
+	js, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// digest reports whether a file is already stored, so a client can skip
+// uploading it. Only whether it exists is answered, not its id.
+//
+//	HEAD /digest?sha256=<hex>&length=<bytes>  200 if stored, 404 if not
+func digest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "HEAD" && r.Method != "GET" {
+		http.Error(w, "method not supported", http.StatusInternalServerError)
+		return
+	}
+	who := new(mode.Primitive)
+	if !identify(w, r, who) {
+		return
+	}
+	tenant, err := mode.LookupTenant(who.Tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	length, err := strconv.Atoi(r.FormValue("length"))
+	if err != nil || r.FormValue("sha256") == "" {
+		http.Error(w, "missing or invalid sha256 or length in query", http.StatusBadRequest)
+		return
+	}
+	_, err = tenant.FindDigest(r.FormValue("sha256"), length)
+	if err == mode.NOT_FOUND {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// audit reports what was done to files, and for whom, over a period that
+// defaults to the last day, as JSON. With users, only members of the
+// auditors group may read it.
+//
+//	GET /audit?from=<RFC3339>&to=<RFC3339>           every file
+//	GET /audit?id=<id>&from=<RFC3339>&to=<RFC3339>   one file
+//	GET /audit?after=<seq>&to=<RFC3339>              the records after the one with seq, of one file with id
+func audit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not supported", http.StatusInternalServerError)
+		return
+	}
+	auditor := new(mode.Primitive)
+	if !identify(w, r, auditor) {
+		return
+	}
+	if users != nil && !member(auditor.Groups, "auditors") {
+		http.Error(w, mode.FORBIDDEN.Error(), http.StatusForbidden)
+		return
+	}
+	tenant, err := mode.LookupTenant(auditor.Tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	to, from := time.Now(), time.Now().Add(-24*time.Hour)
+	if s := r.FormValue("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid from in query", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.FormValue("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid to in query", http.StatusBadRequest)
+			return
+		}
+	}
+	var records []mode.AuditRecord
+	if after := r.FormValue("after"); after != "" {
+		records, err = tenant.ReadAuditAfter(r.FormValue("id"), after, to, 1000)
+	} else if id := r.FormValue("id"); id != "" {
+		records, err = tenant.ReadAuditOf(id, from, to, 1000)
+	} else {
+		records, err = tenant.ReadAudit(from, to, 1000)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	js, err := json.Marshal(records)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// member reports whether group is one of groups
+func member(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver posts changes to files to the webhook, retrying dead letters
+// once an hour. Delivery stops at the first error reaching cockroach, so
+// it is started again, after a wait that doubles up to a minute for as
+// long as it keeps failing straight away.
+func deliver(hook *mode.Webhook) {
+	go func() {
+		for _ = range time.Tick(time.Hour) {
+			n, err := hook.Redeliver()
+			fmt.Println("redelivered webhook events:", n, err)
+		}
+	}()
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := hook.Run(time.Second, nil)
+		log.Println("webhook: ", err)
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		} else if backoff < time.Minute {
+			backoff = backoff * 2
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// collect abandoned upload sessions, expired files, files due to be purged
+// from the trash and chunks released from tiers, and apply the lifecycle
+// rules, in every tenant once an hour
+func collect(rules []mode.Rule) {
+	for _ = range time.Tick(time.Hour) {
+		for _, t := range mode.Tenants() {
+			fmt.Printf("tenant %q\n", t.Name)
+			if rules != nil {
+				actions, err := t.RunLifecycle(rules, false)
+				fmt.Println("lifecycle actions:", len(actions), err)
+			}
+			n, err := t.CollectSessions()
+			fmt.Println("collected sessions:", n, err)
+			n, err = t.SweepExpired()
+			fmt.Println("swept expired files:", n, err)
+			n, err = t.PurgeTrash()
+			fmt.Println("purged trash:", n, err)
+			n, err = t.CollectTiers()
+			fmt.Println("collected tier chunks:", n, err)
+		}
+	}
+}
+
 func main() {
 	hostname := flag.String("roachhost", "localhost", "a valid ip address")
 	portnumber := flag.Int("roachport", 8080, "a valid port name")
+	tierdir := flag.String("tierdir", "", "keep the chunks of large files in this directory")
+	tierover := flag.Int("tierover", 64<<20, "size from which files go to the tier directory")
+	lifecycle := flag.String("lifecycle", "", "file holding lifecycle rules to apply hourly")
+	trashdays := flag.Int("trashdays", 0, "days to keep destroyed files in the trash")
+	events := flag.Bool("events", false, "record changes to files in the event feed")
+	usersfile := flag.String("users", "", "file holding the users who may use the server, anyone may if not set")
+	auditlog := flag.Bool("audit", false, "record who did what to files in the audit log")
+	webhook := flag.String("webhook", "", "URL to post changes to files to")
+	webhooksecret := flag.String("webhooksecret", "", "key the webhook requests are signed with")
+	webhooktypes := flag.String("webhooktypes", "", "comma separated kinds of event posted to the webhook, all if empty")
+	revisions := flag.Bool("revisions", false, "keep earlier revisions of files that are written to, for lifecycle rules to prune")
+	tenantnames := flag.String("tenants", "", "comma separated tenants to serve besides the default one, those of the users or, without users, chosen with ?tenant=<name>")
 
 	flag.Parse()
 
 	fmt.Println("roachhost:", *hostname, " roachport:", *portnumber)
 
+	options := mode.Options{TrashDays: *trashdays, Events: *events || *webhook != "", Audit: *auditlog, Revisions: *revisions}
+	if *tierdir != "" {
+		tier, err := mode.NewDirTier("dir", *tierdir)
+		if err != nil {
+			log.Fatal("tier: ", err)
+		}
+		mode.RegisterTier(tier)
+		options.Tier, options.TierOver = "dir", *tierover
+	}
+	if err := mode.SetOptions(options); err != nil {
+		log.Fatal(err)
+	}
+	if *tenantnames != "" {
+		for _, name := range strings.Split(*tenantnames, ",") {
+			if _, err := mode.RegisterTenant(name, options); err != nil {
+				log.Fatal("tenants: ", err)
+			}
+		}
+	}
+
+	if *usersfile != "" {
+		b, err := ioutil.ReadFile(*usersfile)
+		if err == nil {
+			err = json.Unmarshal(b, &users)
+		}
+		if err != nil {
+			log.Fatal("users: ", err)
+		}
+		for name, u := range users {
+			if _, err := mode.LookupTenant(u.Tenant); err != nil {
+				log.Fatal("users: ", name, ": ", err)
+			}
+		}
+	}
+
+	var rules []mode.Rule
+	if *lifecycle != "" {
+		b, err := ioutil.ReadFile(*lifecycle)
+		if err == nil {
+			err = json.Unmarshal(b, &rules)
+		}
+		if err != nil {
+			log.Fatal("lifecycle: ", err)
+		}
+	}
+
 	mode.OpenRoach(*hostname, *portnumber)
 	defer mode.CloseRoach()
 	//http.HandleFunc("/", sayhelloName) // setting router rule
 	//http.HandleFunc("/login", login)
 	http.HandleFunc("/upload", upload)
 	http.HandleFunc("/download", download)
+	http.HandleFunc("/session", session)
+	http.HandleFunc("/session/finalize", finalize)
+	http.HandleFunc("/multipart", multipart)
+	http.HandleFunc("/multipart/complete", complete)
+	http.HandleFunc("/digest", digest)
+	http.HandleFunc("/audit", audit)
+	go collect(rules)
+	if *webhook != "" {
+		// every tenant has a feed of its own
+		for _, t := range mode.Tenants() {
+			hook := &mode.Webhook{Name: "simple", URL: *webhook, Secret: *webhooksecret, Retries: 5, Backoff: time.Second,
+				Tenant: t.Name}
+			if *webhooktypes != "" {
+				hook.Types = strings.Split(*webhooktypes, ",")
+			}
+			go deliver(hook)
+		}
+	}
 
 	fmt.Println("Simple Server listening on http://localhost:9090/upload")
 	fmt.Println("Simple Server download uri is http://localhost:9090/download?id=<id>")
@@ -0,0 +1,125 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"strings"
+)
+
+// A primitive made for an actor is owned by it. The owner can do anything
+// with the primitive, and is the only one who can change its owner or
+// access control list; anyone else needs a grant in the list for what
+// they do. A grant names an actor, or a group of actors as "group:<name>".
+// Reading covers streaming, opening and cloning the primitive and reading
+// its meta data; writing covers changing its contents or meta data, and
+// locking it; deleting covers destroying it, putting it in the trash,
+// restoring it and purging it.
+//
+// Access is only checked when an actor is given, so trusted code such as
+// the maintenance sweeps, which give none, is never refused. A primitive
+// with no owner, such as one made before owners were recorded, is open to
+// everyone. A refused operation returns FORBIDDEN.
+
+// Permissions an operation needs
+const (
+	PERM_READ   = "read"
+	PERM_WRITE  = "write"
+	PERM_DELETE = "delete"
+)
+
+// Grant gives Principal, an actor or "group:<name>", permissions on a
+// primitive
+type Grant struct {
+	Principal string `json:"principal"`
+	Read      bool   `json:"read,omitempty"`
+	Write     bool   `json:"write,omitempty"`
+	Delete    bool   `json:"delete,omitempty"`
+}
+
+func (g *Grant) gives(perm string) bool {
+	switch perm {
+	case PERM_READ:
+		return g.Read
+	case PERM_WRITE:
+		return g.Write
+	case PERM_DELETE:
+		return g.Delete
+	}
+	return false
+}
+
+// allow returns FORBIDDEN unless p.Actor may do what needs perm to p
+func (p *Primitive) allow(perm string) error {
+	if p.Actor == "" || p.Owner == "" || p.Actor == p.Owner {
+		return nil
+	}
+	for i := range p.ACL {
+		if p.ACL[i].gives(perm) && p.is(p.ACL[i].Principal) {
+			return nil
+		}
+	}
+	return FORBIDDEN
+}
+
+// is reports whether p.Actor is, or is a member of, principal
+func (p *Primitive) is(principal string) bool {
+	if !strings.HasPrefix(principal, "group:") {
+		return principal == p.Actor
+	}
+	for _, group := range p.Groups {
+		if principal == "group:"+group {
+			return true
+		}
+	}
+	return false
+}
+
+// allowChange returns FORBIDDEN unless p.Actor may store p over stored,
+// which needs write permission, delete permission if the expiry or trash
+// time change, and ownership if the owner or access control list change
+func (p *Primitive) allowChange(stored *Primitive) error {
+	if err := stored.allow(PERM_WRITE); err != nil {
+		return err
+	}
+	if p.Expires != stored.Expires || p.Trashed != stored.Trashed {
+		if err := stored.allow(PERM_DELETE); err != nil {
+			return err
+		}
+	}
+	if p.Actor == "" || stored.Owner == "" || p.Actor == stored.Owner {
+		return nil
+	}
+	if p.Owner != stored.Owner || len(p.ACL) != len(stored.ACL) {
+		return FORBIDDEN
+	}
+	for i := range p.ACL {
+		if p.ACL[i] != stored.ACL[i] {
+			return FORBIDDEN
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Append length bytes read from the reader onto the end of an existing
+// primitive. The last chunk, if partial, is filled up first and any
+// remaining bytes are written as new chunks. Length, Chunks and the md5
+// digest are updated in the same transaction as the chunks, so a failed
+// append leaves the primitive as it was.
+func (p *Primitive) Append(reader *bufio.Reader, length int) error {
+	defer timeTrack(time.Now(), "primitive.Append")
+	if length <= 0 {
+		return MISSING_ARG
+	}
+	return p.audit(AUDIT_APPEND, length, kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		err := p.getMeta(txn) // p is now filled out
+		if err != nil {
+			return err
+		}
+		if err := p.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if p.locked(time.Now()) {
+			return LOCKED
+		}
+		if err := p.spill(txn); err != nil {
+			return err
+		}
+		if err := p.keepRevision(txn); err != nil {
+			return err
+		}
+		if err := p.appendFrom(txn, reader, length); err != nil {
+			return err
+		}
+		return p.putMeta(txn)
+	}))
+}
+
+// appendFrom writes length bytes from the reader after the last byte of p
+// and updates p to match, leaving the caller to store the meta data
+func (p *Primitive) appendFrom(txn *client.KV, reader *bufio.Reader, length int) error {
+	if p.CSize == 0 {
+		p.CSize = CHUNK_SIZE
+	}
+	if err := p.spill(txn); err != nil {
+		return err
+	}
+	digest, err := p.resumeDigest(txn)
+	if err != nil {
+		return err
+	}
+
+	var numBytes, tail int
+	last := p.Chunks - 1
+	if last >= 0 && p.Chunking != nil {
+		return p.rechunk(txn, reader, length, digest)
+	}
+	if last >= 0 && p.size(last) < p.CSize {
+		tail = p.size(last)
+	}
+	if p.Refs != nil || tail != 0 {
+		p.cow()
+	}
+	if tail != 0 {
+		// fill the last, partial chunk before starting any new ones,
+		// copying it on write as a reader may be part way through it
+		buf, err := p.getChunk(txn, last)
+		if err != nil {
+			return err
+		}
+		n := p.CSize - tail
+		if length < n {
+			n = length
+		}
+		buf = append(buf, make([]byte, n)...)
+		readOffset, err := io.ReadFull(reader, buf[tail:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New(fmt.Sprintf("bytes read %d doesn't match expected %d", readOffset, length))
+		} else if err != nil {
+			return err
+		}
+		if err := p.replaceChunk(txn, last, buf); err != nil {
+			return err
+		}
+		digest.Write(buf[tail:])
+		numBytes = n
+	}
+
+	if err := p.putChunks(txn, reader, length-numBytes, digest); err != nil {
+		return err
+	}
+	p.Length = p.Length + length
+	return p.setDigest(digest)
+}
+
+// rechunk appends to a primitive with content defined chunks. Its last
+// chunk was cut where the bytes ran out rather than at a boundary, so it is
+// replaced by chunking it again along with the new bytes, giving the same
+// chunks as if everything had been written at once.
+func (p *Primitive) rechunk(txn *client.KV, reader *bufio.Reader, length int, digest *fileDigest) error {
+	last := p.Chunks - 1
+	buf, err := p.getChunk(txn, last)
+	if err != nil {
+		return err
+	}
+	p.cow()
+	if err := p.ns().releaseChunk(txn, p.Tier, p.Refs[last]); err != nil {
+		return err
+	}
+	p.Refs, p.Sizes, p.Chunks = p.Refs[:last], p.Sizes[:last], last
+	// only the new bytes go to the digest, which already has the old
+	added := io.TeeReader(io.LimitReader(reader, int64(length)), digest)
+	combined := bufio.NewReader(io.MultiReader(bytes.NewReader(buf), added))
+	if err := p.putChunks(txn, combined, len(buf)+length, ioutil.Discard); err != nil {
+		return err
+	}
+	p.Length = p.Length + length
+	return p.setDigest(digest)
+}
+
+// resumeDigest returns hashes primed with every byte already stored in the
+// primitive. Primitives written before the digest state was kept in the
+// meta data are re-read to rebuild it.
+func (p *Primitive) resumeDigest(txn *client.KV) (*fileDigest, error) {
+	digest := newDigest()
+	if len(p.Digest) > 0 && len(p.ShaState) > 0 {
+		if err := digest.md5.(encoding.BinaryUnmarshaler).UnmarshalBinary(p.Digest); err != nil {
+			return nil, err
+		}
+		err := digest.sha256.(encoding.BinaryUnmarshaler).UnmarshalBinary(p.ShaState)
+		return digest, err
+	}
+	for i := 0; i < p.Chunks; i++ {
+		buf, err := p.getChunk(txn, i)
+		if err != nil {
+			return nil, err
+		}
+		digest.Write(buf)
+	}
+	return digest, nil
+}
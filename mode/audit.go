@@ -0,0 +1,196 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/twinj/uuid"
+	"github.com/ugorji/go/codec"
+	"log"
+	"time"
+)
+
+// With Options.Audit set, every operation on a primitive through the
+// library is recorded in the audit log once it is done, whether it
+// succeeded or not: who it was done for, when, on which primitive, the
+// number of bytes involved and the result. Destroying primitives by
+// sweeping expired ones or purging the trash is recorded too, with no
+// actor. The log is only ever added to, and can be read by time, or by
+// primitive and time.
+//
+// An operation is recorded once it is done, so failing to record it can't
+// undo it. The operation still returns its own result, as a caller told
+// it failed would do it again, and the record is passed to AuditFailed.
+
+// Operations recorded in the audit log
+const (
+	AUDIT_MAKE     = "make"
+	AUDIT_STREAM   = "stream"
+	AUDIT_DESTROY  = "destroy"
+	AUDIT_SETMETA  = "setmeta"
+	AUDIT_TRASH    = "trash"
+	AUDIT_RESTORE  = "restore"
+	AUDIT_PURGE    = "purge"
+	AUDIT_EXPIRE   = "expire"
+	AUDIT_LOCK     = "lock"
+	AUDIT_HOLD     = "hold"
+	AUDIT_RELEASE  = "release"
+	AUDIT_PRUNE    = "prune"
+	AUDIT_OPEN     = "open"
+	AUDIT_READ     = "read"
+	AUDIT_APPEND   = "append"
+	AUDIT_WRITE    = "write"
+	AUDIT_TRUNCATE = "truncate"
+	AUDIT_CLONE    = "clone"
+	AUDIT_COMPOSE  = "compose"
+)
+
+// AuditFailed is called with each audit record that could not be stored,
+// and the error storing it. It logs them unless it is replaced, for
+// instance to alert someone or to store the record elsewhere.
+var AuditFailed = func(record *AuditRecord, err error) {
+	log.Printf("audit record of %s on %s by %q at %s not stored: %s",
+		record.Op, record.Id, record.Actor, record.Time, err)
+}
+
+// auditTime stamps audit records, in UTC with every digit of the
+// nanoseconds, so that the keys sort in time order
+const auditTime = "2006-01-02T15:04:05.000000000Z"
+
+// AuditRecord is an operation on the primitive with id Id, done for Actor.
+// Result is "ok", or the error the operation returned. Seq places the
+// record in the log, for ReadAuditAfter to carry on from.
+type AuditRecord struct {
+	Time   string `json:"time"`
+	Actor  string `json:"actor"`
+	Op     string `json:"op"`
+	Id     string `json:"id"`
+	Bytes  int    `json:"bytes"`
+	Result string `json:"result"`
+	Seq    string `json:"seq"`
+}
+
+// audit records op on p, involving the given number of bytes, with the
+// result err, if Options.Audit is set. It returns err.
+func (p *Primitive) audit(op string, bytes int, err error) error {
+	t := p.ns()
+	if !t.opts().Audit {
+		return err
+	}
+	record := &AuditRecord{
+		Time:   time.Now().UTC().Format(auditTime),
+		Actor:  p.Actor,
+		Op:     op,
+		Id:     p.Id,
+		Bytes:  bytes,
+		Result: "ok",
+	}
+	if err != nil {
+		record.Result = err.Error()
+	}
+	// the time alone may not be unique
+	record.Seq = record.Time + "|" + uuid.NewV4().String()[:12]
+	e := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := putRecord(txn, proto.Key(t.auditDb+record.Seq), record); err != nil {
+			return err
+		}
+		return putRecord(txn, proto.Key(t.auditIdDb+p.Id+":"+record.Seq), record)
+	})
+	if e != nil {
+		AuditFailed(record, e)
+	}
+	return err
+}
+
+// ReadAudit returns up to max audit records of the default tenant from
+// the time from until the time to, oldest first
+func ReadAudit(from, to time.Time, max int) ([]AuditRecord, error) {
+	return defaultTenant.ReadAudit(from, to, max)
+}
+
+// ReadAuditOf returns up to max audit records of the primitive of the
+// default tenant with the given id from the time from until the time to,
+// oldest first
+func ReadAuditOf(id string, from, to time.Time, max int) ([]AuditRecord, error) {
+	return defaultTenant.ReadAuditOf(id, from, to, max)
+}
+
+// ReadAuditAfter returns up to max audit records of the default tenant
+// following the one with the given Seq, like the ReadAuditAfter of a tenant
+func ReadAuditAfter(id, seq string, to time.Time, max int) ([]AuditRecord, error) {
+	return defaultTenant.ReadAuditAfter(id, seq, to, max)
+}
+
+// ReadAudit returns up to max audit records of t from the time from until
+// the time to, oldest first
+func (t *Tenant) ReadAudit(from, to time.Time, max int) ([]AuditRecord, error) {
+	return readAudit(proto.Key(t.auditDb+from.UTC().Format(auditTime)), t.auditDb, to, max)
+}
+
+// ReadAuditOf returns up to max audit records of the primitive of t with
+// the given id from the time from until the time to, oldest first
+func (t *Tenant) ReadAuditOf(id string, from, to time.Time, max int) ([]AuditRecord, error) {
+	if id == "" {
+		return nil, MISSING_ARG
+	}
+	prefix := t.auditIdDb + id + ":"
+	return readAudit(proto.Key(prefix+from.UTC().Format(auditTime)), prefix, to, max)
+}
+
+// ReadAuditAfter returns up to max audit records of t following the one
+// with the given Seq until the time to, oldest first, those of the
+// primitive with the given id if it isn't "". Reading on from the Seq of
+// the last record read pages through the log without missing any.
+func (t *Tenant) ReadAuditAfter(id, seq string, to time.Time, max int) ([]AuditRecord, error) {
+	if seq == "" {
+		return nil, MISSING_ARG
+	}
+	prefix := t.auditDb
+	if id != "" {
+		prefix = t.auditIdDb + id + ":"
+	}
+	return readAudit(proto.Key(prefix+seq).Next(), prefix, to, max)
+}
+
+func readAudit(start proto.Key, prefix string, to time.Time, max int) ([]AuditRecord, error) {
+	end := proto.Key(prefix + to.UTC().Format(auditTime))
+	rows, err := scan(kvClient, start, end, int64(max))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]AuditRecord, 0, len(rows))
+	for _, row := range rows {
+		var record AuditRecord
+		var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+		if err := dec.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
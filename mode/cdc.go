@@ -0,0 +1,111 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Chunking sets the sizes of content defined chunks. Rather than cutting a
+// primitive every Options.ChunkSize bytes, chunks are cut where a rolling
+// hash of the bytes matches a pattern, as in FastCDC, so that inserting or
+// removing bytes only changes the chunks around the edit and the rest
+// deduplicate as before. Chunks are at least Min and at most Max bytes,
+// and Avg bytes on average, bar the last chunk which ends with the
+// primitive. Writes in place keep the boundaries the primitive has, while
+// appends cut the last chunk again along with the new bytes. The parts of
+// multipart uploads are cut every CSize bytes of the primitive, which is
+// Max, rather than by content.
+type Chunking struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+// gear maps each byte to a random value for the rolling hash. It must
+// never change, or chunks stored before and after would no longer match.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 from a fixed seed
+	seed := uint64(0x726f616368636c69)
+	for i := range gear {
+		seed = seed + 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+func (c *Chunking) validate() error {
+	if c.Min < 64 || c.Min >= c.Avg || c.Avg >= c.Max {
+		return errors.New(fmt.Sprintf("chunk sizes must satisfy 64 <= min < avg < max, got %d, %d, %d", c.Min, c.Avg, c.Max))
+	}
+	return nil
+}
+
+// cut returns the length of the first chunk of buf. A chunk is only cut
+// short of len(buf) at a boundary, so buf should hold Max bytes unless it
+// holds the end of the primitive.
+func (c *Chunking) cut(buf []byte) int {
+	n := len(buf)
+	if n <= c.Min {
+		return n
+	}
+	if n > c.Max {
+		n = c.Max
+	}
+	// boundaries are harder to match before Avg and easier after, which
+	// keeps chunk sizes close to Avg
+	var bits uint
+	for 1<<(bits+1) <= c.Avg {
+		bits = bits + 1
+	}
+	small := ^uint64(0) << (64 - (bits + 1))
+	large := ^uint64(0) << (64 - (bits - 1))
+	normal := c.Avg
+	if normal > n {
+		normal = n
+	}
+	var hash uint64
+	i := c.Min
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[buf[i]]
+		if hash&small == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[buf[i]]
+		if hash&large == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
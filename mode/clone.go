@@ -0,0 +1,143 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/twinj/uuid"
+	"time"
+)
+
+// Chunks may be shared by more than one primitive. Sharing is tracked in
+// the ref subspace, keyed by chunk, holding the number of primitives that
+// use the chunk besides the one that wrote it. A chunk with no ref record
+// belongs to a single primitive, so unshared chunks cost nothing extra.
+
+// Clone makes a new primitive with the same contents as the primitive with
+// id p.Id, without copying any chunk data: the clone's meta data points at
+// the same chunks, whose reference counts are raised. Either primitive can
+// later be written, truncated or destroyed without affecting the other.
+// The clone takes the name and mime type of the original, but is made now,
+// for the actor, with no access control list, expiry, lock or hold.
+func (p *Primitive) Clone() (*Primitive, error) {
+	defer timeTrack(time.Now(), "primitive.Clone")
+	var clone *Primitive
+	e := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		err := p.getMeta(txn) // p is now filled out
+		if err != nil {
+			return err
+		}
+		if err := p.allow(PERM_READ); err != nil {
+			return err
+		}
+		clone = &Primitive{Id: uuid.NewV4().String(), Name: p.Name, MimeType: p.MimeType,
+			Created: time.Now().UTC().Format(time.RFC3339), Owner: p.Owner,
+			Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+		// the clone is the actor's own
+		if p.Actor != "" {
+			clone.Owner = p.Actor
+		}
+		if err := clone.cloneOf(txn, p); err != nil {
+			return err
+		}
+		return clone.putMeta(txn)
+	})
+	// recorded as an operation on the original, which the clone reads
+	if e := p.audit(AUDIT_CLONE, p.Length, e); e != nil {
+		return nil, e
+	}
+	return clone, nil
+}
+
+// cloneOf makes p a clone of source sharing its chunks. Only the contents
+// and how they are stored are taken from source; p keeps its id, name,
+// owner, access control list, times and the rest.
+func (p *Primitive) cloneOf(txn *client.KV, source *Primitive) error {
+	p.Length, p.CSize, p.Chunks = source.Length, source.CSize, source.Chunks
+	p.Md5, p.Sha256, p.Digest, p.ShaState = source.Md5, source.Sha256, source.Digest, source.ShaState
+	p.Codec, p.Dedup, p.Chunking = source.Codec, source.Dedup, source.Chunking
+	p.Cipher, p.KeyId, p.DataKey, p.aead = source.Cipher, source.KeyId, source.DataKey, source.aead
+	p.Data, p.Pack, p.PackOff, p.PackLen = source.Data, source.Pack, source.PackOff, source.PackLen
+	p.Erasure, p.Tier = source.Erasure, source.Tier
+	p.Sizes = nil
+	if source.Sizes != nil {
+		p.Sizes = append([]int{}, source.Sizes...)
+	}
+	p.Stripes = nil
+	p.Gen = 0
+	// inline contents are copied along with the meta data
+	if source.Data != nil {
+		p.Refs = nil
+		return nil
+	}
+	if source.Pack != "" {
+		p.Refs = nil
+		return p.sharePacked(txn, source)
+	}
+	p.Refs = make([]string, source.Chunks)
+	for i := range p.Refs {
+		p.Refs[i] = source.ref(i)
+		if err := p.ns().shareChunk(txn, p.Refs[i]); err != nil {
+			return err
+		}
+	}
+	p.Stripes = append([]Stripe(nil), source.Stripes...)
+	for _, stripe := range p.Stripes {
+		for _, ref := range stripe.Parity {
+			if err := p.ns().shareChunk(txn, ref); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shareChunk records one more primitive of t using the chunk
+func (t *Tenant) shareChunk(kv *client.KV, ref string) error {
+	incResp := &proto.IncrementResponse{}
+	return kv.Call(proto.Increment, proto.IncrementArgs(proto.Key(t.refDb+ref), 1), incResp)
+}
+
+// releaseChunk records that a primitive of t no longer uses the chunk,
+// stored in the named tier, and deletes it if no other primitive does
+func (t *Tenant) releaseChunk(kv *client.KV, tier, ref string) error {
+	incResp := &proto.IncrementResponse{}
+	if err := kv.Call(proto.Increment, proto.IncrementArgs(proto.Key(t.refDb+ref), -1), incResp); err != nil {
+		return err
+	}
+	if incResp.NewValue >= 0 {
+		return nil
+	}
+	if err := t.deleteStored(kv, tier, ref); err != nil {
+		return err
+	}
+	delReq := &proto.DeleteRequest{}
+	delReq.Key = proto.Key(t.refDb + ref)
+	delResp := &proto.DeleteResponse{}
+	return kv.Call(proto.Delete, delReq, delResp)
+}
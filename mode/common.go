@@ -30,17 +30,91 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
+	"github.com/ugorji/go/codec"
 	"net/http"
 )
 
 var EOF = errors.New("EOF")
 var NOT_FOUND = errors.New("Primitive Not Found")
 var MISSING_ARG = errors.New("missing required arg")
+var CHANGED = errors.New("Primitive changed while reading")
+var SESSION_NOT_FOUND = errors.New("Session Not Found")
+var WRONG_OFFSET = errors.New("offset does not match bytes committed")
+var UPLOAD_NOT_FOUND = errors.New("Multipart Upload Not Found")
+var PART_NOT_FOUND = errors.New("Part Not Found")
+var LOCKED = errors.New("Primitive is locked")
+var FORBIDDEN = errors.New("Forbidden")
+
+var errChunkMissing = errors.New("chunk missing")
 
 var kvClient *client.KV
 
+// Options control how new primitives are stored. Existing primitives keep
+// the settings they were written with, which are recorded in their meta data.
+type Options struct {
+	Compression string      // name of a registered Codec to compress chunks with, "" for none
+	Keys        KeyProvider // master keys to encrypt chunks under, nil for none
+	Dedup       bool        // store chunks by content hash, once however many primitives hold them
+	Chunking    *Chunking   // cut content defined chunks of these sizes, nil for chunks of CHUNK_SIZE
+	DedupFiles  bool        // make a clone of an identical stored primitive rather than storing it again
+	Inline      int         // store primitives of up to this many bytes in their meta data, 0 for none
+	Pack        int         // pack primitives of up to this many bytes, and over Inline, together, 0 for none
+	Erasure     *Erasure    // erasure code the chunks of primitives, nil for none
+	Tier        string      // name of a registered Tier to keep the chunks of primitives in, "" for cockroach
+	TierOver    int         // tier only primitives of at least this many bytes, or of unknown length
+	TrashDays   int         // keep destroyed primitives in the trash this many days, 0 to destroy them at once
+	Events      bool        // record every change to a primitive in the event feed
+	Audit       bool        // record every operation on a primitive, and who did it, in the audit log
+	ChunkSize   int         // size of the chunks of new primitives, 0 for CHUNK_SIZE
+	Revisions   bool        // keep the contents a write, truncate or append replaces as a revision
+}
+
+// SetOptions changes how primitives of the default tenant made from now on
+// are stored. The key provider is also used to read primitives that are
+// already encrypted, so it must keep every master key that is still in
+// use.
+func SetOptions(o Options) error {
+	return defaultTenant.SetOptions(o)
+}
+
+// validate checks the options can be used
+func (o *Options) validate() error {
+	if _, ok := codecs[o.Compression]; o.Compression != "" && !ok {
+		return errors.New(fmt.Sprintf("unknown codec %s", o.Compression))
+	}
+	if o.Chunking != nil {
+		if err := o.Chunking.validate(); err != nil {
+			return err
+		}
+	}
+	if o.Erasure != nil {
+		if _, err := newReedSolomon(o.Erasure.Data, o.Erasure.Parity); err != nil {
+			return err
+		}
+	}
+	if _, ok := tiers[o.Tier]; o.Tier != "" && !ok {
+		return errors.New(fmt.Sprintf("unknown tier %s", o.Tier))
+	}
+	// chunks stored by content hash are shared through cockroach
+	if o.Dedup && o.Tier != "" {
+		return errors.New("deduplication can't be combined with a tier")
+	}
+	if o.Pack > PACK_SIZE {
+		return errors.New(fmt.Sprintf("pack threshold %d is over PACK_SIZE", o.Pack))
+	}
+	// identical chunks encrypt differently under each data key
+	if o.Dedup && o.Keys != nil {
+		return errors.New("deduplication can't be combined with encryption")
+	}
+	if o.ChunkSize < 0 {
+		return errors.New(fmt.Sprintf("negative chunk size %d", o.ChunkSize))
+	}
+	return nil
+}
+
 func OpenRoach(hostname string, port int) {
 	// Key Value Client initialization.
 
@@ -58,3 +132,42 @@ func OpenRoach(hostname string, port int) {
 func CloseRoach() {
 	kvClient.Close()
 }
+
+// scan returns up to max key value pairs with keys from start up to, but
+// not including, end
+func scan(kv *client.KV, start, end proto.Key, max int64) ([]proto.KeyValue, error) {
+	scanReq := &proto.ScanRequest{}
+	scanReq.Key = start
+	scanReq.EndKey = end
+	scanReq.MaxResults = max
+	scanResp := &proto.ScanResponse{}
+	if err := kv.Call(proto.Scan, scanReq, scanResp); err != nil {
+		return nil, err
+	}
+	return scanResp.Rows, nil
+}
+
+// getRecord decodes the msgpack value stored at key into v, returning
+// NOT_FOUND if there is none
+func getRecord(kv *client.KV, key proto.Key, v interface{}) error {
+	getResp := &proto.GetResponse{}
+	if err := kv.Call(proto.Get, proto.GetArgs(key), getResp); err != nil {
+		return err
+	}
+	if getResp.Value == nil {
+		return NOT_FOUND
+	}
+	var dec *codec.Decoder = codec.NewDecoderBytes(getResp.Value.Bytes, mph)
+	return dec.Decode(v)
+}
+
+// putRecord stores v at key, encoded with msgpack
+func putRecord(kv *client.KV, key proto.Key, v interface{}) error {
+	var buf []byte
+	var enc *codec.Encoder = codec.NewEncoderBytes(&buf, mph) // mph is the msgpack codec
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	putResp := &proto.PutResponse{}
+	return kv.Call(proto.Put, proto.PutArgs(key, buf), putResp)
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bytes"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/twinj/uuid"
+	"time"
+)
+
+// Compose makes a new primitive whose contents are the contents of the
+// primitives with the given ids, in order. Chunk data is not copied where
+// it can be avoided: the new primitive refers to the chunks of its sources,
+// which are shared as with Clone, so the sources may be destroyed
+// afterwards. The new primitive is stored like the first source, and the
+// chunks of any source stored differently, for instance with another
+// codec or data key, are copied over. Name and MimeType are taken from p;
+// the rest of p is filled out for the new primitive.
+func (p *Primitive) Compose(ids []string) error {
+	defer timeTrack(time.Now(), "primitive.Compose")
+	if len(ids) == 0 {
+		return MISSING_ARG
+	}
+	var id = uuid.NewV4().String()
+	err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		p.Id = id
+		p.Length = 0
+		p.Chunks = 0
+		p.CSize = CHUNK_SIZE
+		p.Refs = []string{}
+		p.Sizes = []int{}
+		p.Gen = 0
+		p.Stripes = nil
+		if p.Created == "" {
+			p.Created = time.Now().UTC().Format(time.RFC3339)
+		}
+		if p.Owner == "" {
+			p.Owner = p.Actor
+		}
+		for i, sid := range ids {
+			source := Primitive{Id: sid, Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+			err := source.getMeta(txn)
+			if err != nil {
+				return err
+			}
+			if err := source.allow(PERM_READ); err != nil {
+				return err
+			}
+			if i == 0 {
+				p.Codec = source.Codec
+				p.Dedup = source.Dedup
+				p.Chunking = source.Chunking
+				p.Erasure = source.Erasure
+				p.Tier = source.Tier
+				if source.CSize > 0 {
+					p.CSize = source.CSize
+				}
+				if p.Chunking != nil {
+					p.CSize = p.Chunking.Max
+				}
+				p.Cipher, p.KeyId, p.DataKey, p.aead = source.Cipher, source.KeyId, source.DataKey, nil
+			}
+			for j := 0; j < source.Chunks; j++ {
+				if !p.storedLike(&source) {
+					buf, err := source.getChunk(txn, j)
+					if err != nil {
+						return err
+					}
+					if err := p.replaceChunk(txn, p.Chunks, buf); err != nil {
+						return err
+					}
+					continue
+				}
+				ref := source.ref(j)
+				if err := p.ns().shareChunk(txn, ref); err != nil {
+					return err
+				}
+				p.Refs = append(p.Refs, ref)
+				p.Sizes = append(p.Sizes, source.size(j))
+				p.Chunks = p.Chunks + 1
+			}
+			p.Length = p.Length + source.Length
+		}
+		// the digest can't be derived from those of the sources, so it
+		// is computed from the chunks
+		if err := p.rehash(txn); err != nil {
+			return err
+		}
+		return p.putMeta(txn)
+	})
+	return p.audit(AUDIT_COMPOSE, p.Length, err)
+}
+
+// storedLike reports whether the chunks of source can be read as chunks
+// of p, so that p may share them. Clones share a data key, which may be
+// wrapped differently once either has had its key rotated. Inline and
+// packed contents have no chunk to share, and chunks in another tier are
+// not where p would look for them.
+func (p *Primitive) storedLike(source *Primitive) bool {
+	if p.Codec != source.Codec || p.Cipher != source.Cipher || p.Tier != source.Tier || source.Data != nil || source.Pack != "" {
+		return false
+	}
+	if p.Cipher == "" || (p.KeyId == source.KeyId && bytes.Equal(p.DataKey, source.DataKey)) {
+		return true
+	}
+	key, err := p.unwrapKey()
+	if err != nil {
+		return false
+	}
+	other, err := source.unwrapKey()
+	return err == nil && bytes.Equal(key, other)
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Codec compresses chunks. Codecs are registered by name, and the name of
+// the codec a primitive was written with is kept in its meta data, so a
+// codec must stay registered for as long as primitives written with it
+// exist.
+type Codec interface {
+	Name() string
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+var codecs = make(map[string]Codec)
+
+// RegisterCodec makes a codec available for Options.Compression and for
+// reading primitives written with it
+func RegisterCodec(c Codec) {
+	codecs[c.Name()] = c
+}
+
+func init() {
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(flateCodec{})
+}
+
+// When a primitive has a codec, every chunk starts with one of these, as
+// chunks that don't shrink when compressed are stored as they are
+const (
+	chunkRaw        = 0
+	chunkCompressed = 1
+)
+
+// compress compresses a chunk of p for storage
+func (p *Primitive) compress(buf []byte) ([]byte, error) {
+	if p.Codec == "" {
+		return buf, nil
+	}
+	c, ok := codecs[p.Codec]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown codec %s", p.Codec))
+	}
+	z, err := c.Compress(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(z) >= len(buf) {
+		return append([]byte{chunkRaw}, buf...), nil
+	}
+	return append([]byte{chunkCompressed}, z...), nil
+}
+
+// decompress undoes compress
+func (p *Primitive) decompress(value []byte) ([]byte, error) {
+	if p.Codec == "" {
+		return value, nil
+	}
+	if len(value) == 0 {
+		return nil, errors.New("chunk is missing its header")
+	}
+	switch value[0] {
+	case chunkRaw:
+		return value[1:], nil
+	case chunkCompressed:
+		c, ok := codecs[p.Codec]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unknown codec %s", p.Codec))
+		}
+		return c.Decompress(value[1:])
+	}
+	return nil, errors.New(fmt.Sprintf("unknown chunk header %d", value[0]))
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(b []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w := gzip.NewWriter(&out)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Name() string { return "flate" }
+
+func (flateCodec) Compress(b []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := flate.NewWriter(&out, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (flateCodec) Decompress(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
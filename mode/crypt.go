@@ -0,0 +1,182 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Chunks are encrypted with AES-256 in GCM mode under a data key of their
+// own primitive, with a random 96 bit nonce stored in front of each chunk
+// and the key of the chunk as additional authenticated data, so a chunk
+// moved to another key, of the same or another primitive, fails to
+// decrypt. The data key is kept in the meta data wrapped by a master key
+// from a KeyProvider, which never leaves the provider.
+const CIPHER = "aes256-gcm/random96"
+
+// KeyProvider wraps and unwraps data keys with master keys. Wrap uses the
+// current master key and returns its id, which is recorded in the meta
+// data and passed back to Unwrap, so a provider must be able to unwrap
+// with every master key it has ever wrapped with.
+type KeyProvider interface {
+	Wrap(key []byte) (keyId string, wrapped []byte, err error)
+	Unwrap(keyId string, wrapped []byte) ([]byte, error)
+}
+
+// MasterKeys is a KeyProvider holding 32 byte master keys in memory, by
+// id. Data keys are wrapped with the key named by Current.
+type MasterKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (m *MasterKeys) Wrap(key []byte) (string, []byte, error) {
+	aead, err := m.aead(m.Current)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return m.Current, aead.Seal(nonce, nonce, key, []byte(m.Current)), nil
+}
+
+func (m *MasterKeys) Unwrap(keyId string, wrapped []byte) ([]byte, error) {
+	aead, err := m.aead(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyId))
+}
+
+func (m *MasterKeys) aead(keyId string) (cipher.AEAD, error) {
+	key, ok := m.Keys[keyId]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown master key %s", keyId))
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newDataKey gives p a new data key if the current options of its tenant
+// call for encryption, and clears any it had otherwise
+func (p *Primitive) newDataKey() error {
+	p.Cipher, p.KeyId, p.DataKey, p.aead = "", "", nil, nil
+	keys := p.ns().opts().Keys
+	if keys == nil {
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	keyId, wrapped, err := keys.Wrap(key)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	p.Cipher, p.KeyId, p.DataKey, p.aead = CIPHER, keyId, wrapped, aead
+	return nil
+}
+
+// dataKey returns the unwrapped data key of p, ready for use
+func (p *Primitive) dataKey() (cipher.AEAD, error) {
+	if p.aead != nil {
+		return p.aead, nil
+	}
+	key, err := p.unwrapKey()
+	if err != nil {
+		return nil, err
+	}
+	p.aead, err = newAEAD(key)
+	return p.aead, err
+}
+
+// unwrapKey returns the plain data key of p
+func (p *Primitive) unwrapKey() ([]byte, error) {
+	if p.Cipher != CIPHER {
+		return nil, errors.New(fmt.Sprintf("unknown cipher %s", p.Cipher))
+	}
+	keys := p.ns().opts().Keys
+	if keys == nil {
+		return nil, errors.New("primitive is encrypted but no key provider is set")
+	}
+	return keys.Unwrap(p.KeyId, p.DataKey)
+}
+
+// seal encrypts a chunk of p that is to be stored under ref
+func (p *Primitive) seal(ref string, buf []byte) ([]byte, error) {
+	if p.Cipher == "" {
+		return buf, nil
+	}
+	aead, err := p.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, buf, []byte(p.ns().pdb+ref)), nil
+}
+
+// open decrypts a chunk of p that was stored under ref
+func (p *Primitive) open(ref string, value []byte) ([]byte, error) {
+	if p.Cipher == "" {
+		return value, nil
+	}
+	aead, err := p.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(value) < aead.NonceSize() {
+		return nil, errors.New(fmt.Sprintf("chunk %s is too short", ref))
+	}
+	buf, err := aead.Open(nil, value[:aead.NonceSize()], value[aead.NonceSize():], []byte(p.ns().pdb+ref))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("chunk %s failed authentication", ref))
+	}
+	return buf, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// Chunks of deduplicated primitives are stored in the
+// datamode.Primitive.Chunk subspace under the sha256 of their stored
+// bytes, so identical chunks, of the same or different primitives, are
+// stored once. Each further primitive holding a chunk counts as a referrer
+// of it, just as a clone does, and the chunk is deleted with its last
+// referrer. Chunks are hashed after compression, so the same bytes
+// compressed with different codecs are stored separately and each chunk
+// reads back with the codec of any primitive referring to it.
+const contentPrefix = "chunk:"
+
+// putContent stores the chunk value of a primitive of t under its content
+// hash, or adds a reference to the chunk already stored there, returning
+// its ref
+func (t *Tenant) putContent(kv *client.KV, value []byte) (string, error) {
+	sum := sha256.Sum256(value)
+	ref := contentPrefix + hex.EncodeToString(sum[:])
+	getResp := &proto.GetResponse{}
+	if err := kv.Call(proto.Get, proto.GetArgs(proto.Key(t.pdb+ref)), getResp); err != nil {
+		return "", err
+	}
+	if getResp.Value != nil {
+		return ref, t.shareChunk(kv, ref)
+	}
+	putResp := &proto.PutResponse{}
+	return ref, kv.Call(proto.Put, proto.PutArgs(proto.Key(t.pdb+ref), value), putResp)
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"hash"
+	"strings"
+)
+
+// Primitives are indexed by digest in the datamode.Primitive.Digest
+// subspace, keyed by sha256, length and id, so identical files can be
+// found. md5 is kept for clients comparing what they sent, but since md5
+// collisions are easily made files are only ever matched on sha256.
+
+// fileDigest hashes the contents of a primitive with md5 and sha256
+type fileDigest struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newDigest() *fileDigest {
+	return &fileDigest{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (d *fileDigest) Write(b []byte) (int, error) {
+	d.md5.Write(b)
+	return d.sha256.Write(b)
+}
+
+// FindDigest returns the id of a primitive of the default tenant with the
+// given length whose sha256, in hex, is as given, or NOT_FOUND if there is
+// none
+func FindDigest(sha256 string, length int) (string, error) {
+	return defaultTenant.FindDigest(sha256, length)
+}
+
+// FindDigest returns the id of a primitive of t with the given length whose
+// sha256, in hex, is as given, or NOT_FOUND if there is none. It lets a
+// client ask whether a file is stored already before uploading it. Knowing
+// a digest doesn't prove having the file, so only the id is returned, and
+// reading the primitive is checked like any other read.
+func (t *Tenant) FindDigest(sha256 string, length int) (string, error) {
+	p, err := t.findDigest(kvClient, strings.ToLower(sha256), length)
+	if err != nil {
+		return "", err
+	}
+	return p.Id, nil
+}
+
+func (t *Tenant) findDigest(kv *client.KV, sha256 string, length int) (*Primitive, error) {
+	if sha256 == "" {
+		return nil, MISSING_ARG
+	}
+	start := proto.Key(fmt.Sprintf("%s%s:%d:", t.digestDb, sha256, length))
+	rows, err := scan(kv, start, start.PrefixEnd(), 10)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		p := &Primitive{Id: strings.TrimPrefix(string(row.Key), string(start)), Tenant: t.Name}
+		err := p.getMeta(kv)
+		if err == NOT_FOUND {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if p.Sha256 == sha256 && p.Length == length {
+			return p, nil
+		}
+	}
+	return nil, NOT_FOUND
+}
+
+// digestKey returns the key of the digest index entry of p
+func (p *Primitive) digestKey() proto.Key {
+	return proto.Key(fmt.Sprintf("%s%s:%d:%s", p.ns().digestDb, p.Sha256, p.Length, p.Id))
+}
+
+// index moves the index entries of p to match it, and records the change
+// in the event feed
+func (p *Primitive) index(kv *client.KV) error {
+	old, err := p.reindex(kv)
+	if err != nil {
+		return err
+	}
+	return p.emitChange(kv, old)
+}
+
+// unindex removes the index entries of p, which is being destroyed, and
+// records its end in the event feed
+func (p *Primitive) unindex(kv *client.KV) error {
+	// an empty primitive has no index entries
+	gone := &Primitive{Id: p.Id, Tenant: p.Tenant}
+	old, err := gone.reindex(kv)
+	if err != nil {
+		return err
+	}
+	return gone.emitEnd(kv, old)
+}
+
+// reindex moves the index entries of p from those it had in the meta data
+// stored so far, which is returned
+func (p *Primitive) reindex(kv *client.KV) (*Primitive, error) {
+	old := &Primitive{Tenant: p.Tenant}
+	if err := getRecord(kv, p.ns().metaKey(p.Id), old); err != nil && err != NOT_FOUND {
+		return nil, err
+	}
+	if err := p.indexDigest(kv, old); err != nil {
+		return nil, err
+	}
+	if err := p.indexExpiry(kv, old); err != nil {
+		return nil, err
+	}
+	return old, p.indexTrash(kv, old)
+}
+
+// indexDigest moves the digest index entry of p from that of old
+func (p *Primitive) indexDigest(kv *client.KV, old *Primitive) error {
+	if old.Sha256 == p.Sha256 && old.Length == p.Length {
+		return nil
+	}
+	if old.Sha256 != "" {
+		delReq := &proto.DeleteRequest{}
+		delReq.Key = old.digestKey()
+		if err := kv.Call(proto.Delete, delReq, &proto.DeleteResponse{}); err != nil {
+			return err
+		}
+	}
+	if p.Sha256 == "" {
+		return nil
+	}
+	putResp := &proto.PutResponse{}
+	return kv.Call(proto.Put, proto.PutArgs(p.digestKey(), []byte(p.Id)), putResp)
+}
+
+// becomeClone drops the chunks p has written and makes p a clone of
+// existing, which has the same contents. Only the chunks are shared: p
+// keeps its own id, name, owner, access control list, expiry, lock and the
+// rest, whoever uploaded existing.
+func (p *Primitive) becomeClone(txn *client.KV, existing *Primitive) error {
+	if err := p.releaseChunks(txn); err != nil {
+		return err
+	}
+	if err := p.cloneOf(txn, existing); err != nil {
+		return err
+	}
+	return p.putMeta(txn)
+}
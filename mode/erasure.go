@@ -0,0 +1,334 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/ugorji/go/codec"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Erasure sets how the chunks of a primitive are erasure coded. Each
+// stripe of Data consecutive chunks is stored along with Parity parity
+// chunks under keys of their own, and any Data of the chunks and parity
+// chunks of a stripe are enough to rebuild the rest, so up to Parity
+// chunks of each stripe may be lost or damaged. Lost chunks are rebuilt as
+// they are read; Repair writes them back.
+//
+// Parity is computed by putMeta for every stripe whose chunks have changed
+// since it was last computed. Chunks are copied on write, so a stripe is
+// known by the keys of its chunks. Inline and packed primitives, having
+// no chunks of their own, are not erasure coded.
+type Erasure struct {
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+}
+
+// Stripe is the parity of a stripe of chunks
+type Stripe struct {
+	Of     string   `json:"of"`     // fingerprint of the keys of the chunks the parity was computed from
+	Parity []string `json:"parity"` // keys of the parity chunks, less the primitive prefix
+	Sums   []uint32 `json:"sums"`   // crc32 of each chunk then each parity chunk, decoded
+}
+
+// protect brings the parity of p up to date with its chunks
+func (p *Primitive) protect(kv *client.KV) error {
+	if p.Erasure == nil || p.Data != nil || p.Pack != "" {
+		return nil
+	}
+	rs, err := newReedSolomon(p.Erasure.Data, p.Erasure.Parity)
+	if err != nil {
+		return err
+	}
+	stripes := (p.Chunks + p.Erasure.Data - 1) / p.Erasure.Data
+	if err := p.releaseParity(kv, stripes); err != nil {
+		return err
+	}
+	for s := 0; s < stripes; s++ {
+		of := p.fingerprint(s)
+		if s < len(p.Stripes) && p.Stripes[s].Of == of {
+			continue
+		}
+		if s < len(p.Stripes) {
+			for _, ref := range p.Stripes[s].Parity {
+				if err := p.ns().releaseChunk(kv, p.Tier, ref); err != nil {
+					return err
+				}
+			}
+		} else {
+			p.Stripes = append(p.Stripes, Stripe{})
+		}
+		stripe, err := p.encodeStripe(kv, rs, s, of)
+		if err != nil {
+			return err
+		}
+		p.Stripes[s] = *stripe
+	}
+	return nil
+}
+
+// encodeStripe computes and stores the parity of stripe s
+func (p *Primitive) encodeStripe(kv *client.KV, rs *reedSolomon, s int, of string) (*Stripe, error) {
+	size := p.stripeSize(s)
+	stripe := &Stripe{Of: of, Sums: make([]uint32, rs.data+rs.parity)}
+	shards := make([][]byte, rs.data+rs.parity)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		c := s*rs.data + i
+		if i >= rs.data || c >= p.Chunks {
+			continue
+		}
+		buf, err := p.getChunk(kv, c)
+		if err != nil {
+			return nil, err
+		}
+		copy(shards[i], buf)
+		stripe.Sums[i] = crc32.ChecksumIEEE(buf)
+	}
+	rs.encode(shards)
+	for k := 0; k < rs.parity; k++ {
+		ref, err := p.putChunk(kv, fmt.Sprintf("%s:parity:%s:%d", p.Id, of[:16], k), shards[rs.data+k])
+		if err != nil {
+			return nil, err
+		}
+		stripe.Parity = append(stripe.Parity, ref)
+		stripe.Sums[rs.data+k] = crc32.ChecksumIEEE(shards[rs.data+k])
+	}
+	return stripe, nil
+}
+
+// releaseParity releases the parity chunks of every stripe from number
+// from on, and drops the stripes
+func (p *Primitive) releaseParity(kv *client.KV, from int) error {
+	for s := from; s < len(p.Stripes); s++ {
+		for _, ref := range p.Stripes[s].Parity {
+			if err := p.ns().releaseChunk(kv, p.Tier, ref); err != nil {
+				return err
+			}
+		}
+	}
+	if from < len(p.Stripes) {
+		p.Stripes = p.Stripes[:from]
+	}
+	return nil
+}
+
+// fingerprint identifies stripe s by the keys of its chunks
+func (p *Primitive) fingerprint(s int) string {
+	h := sha256.New()
+	for c := s * p.Erasure.Data; c < (s+1)*p.Erasure.Data && c < p.Chunks; c++ {
+		io.WriteString(h, p.ref(c))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stripeSize returns the size of the largest chunk of stripe s, to which
+// the others are padded with zeros
+func (p *Primitive) stripeSize(s int) int {
+	var size int
+	for c := s * p.Erasure.Data; c < (s+1)*p.Erasure.Data && c < p.Chunks; c++ {
+		if p.size(c) > size {
+			size = p.size(c)
+		}
+	}
+	return size
+}
+
+// stripe returns the parity of the stripe holding chunk n, or nil if it
+// has none that is current
+func (p *Primitive) stripe(n int) *Stripe {
+	s := n / p.Erasure.Data
+	if s >= len(p.Stripes) || p.Stripes[s].Of != p.fingerprint(s) {
+		return nil
+	}
+	return &p.Stripes[s]
+}
+
+// intact reports whether buf, read as chunk n, matches its checksum
+func (p *Primitive) intact(n int, buf []byte) bool {
+	stripe := p.stripe(n)
+	return stripe == nil || crc32.ChecksumIEEE(buf) == stripe.Sums[n%p.Erasure.Data]
+}
+
+// readStripe reads every shard of stripe s, padded to the same size,
+// leaving out those that are missing or damaged and listing them in lost
+func (p *Primitive) readStripe(kv *client.KV, s int) ([][]byte, []int, error) {
+	d := p.Erasure.Data
+	stripe := p.stripe(s * d)
+	if stripe == nil {
+		return nil, nil, errors.New(fmt.Sprintf("stripe %d of %s has no parity", s, p.Id))
+	}
+	size := p.stripeSize(s)
+	shards := make([][]byte, d+p.Erasure.Parity)
+	var lost []int
+	for i := range shards {
+		c := s*d + i
+		if i < d && c >= p.Chunks {
+			shards[i] = make([]byte, size)
+			continue
+		}
+		var ref string
+		if i < d {
+			ref = p.ref(c)
+		} else {
+			ref = stripe.Parity[i-d]
+		}
+		buf, err := p.fetch(kv, ref)
+		if err != nil || crc32.ChecksumIEEE(buf) != stripe.Sums[i] || len(buf) > size {
+			lost = append(lost, i)
+			continue
+		}
+		shards[i] = append(buf, make([]byte, size-len(buf))...)
+	}
+	return shards, lost, nil
+}
+
+// rebuild reconstructs chunk n from the rest of its stripe
+func (p *Primitive) rebuild(kv *client.KV, n int) ([]byte, error) {
+	rs, err := newReedSolomon(p.Erasure.Data, p.Erasure.Parity)
+	if err != nil {
+		return nil, err
+	}
+	shards, _, err := p.readStripe(kv, n/p.Erasure.Data)
+	if err != nil {
+		return nil, err
+	}
+	if err := rs.reconstruct(shards); err != nil {
+		return nil, err
+	}
+	return shards[n%p.Erasure.Data][:p.size(n)], nil
+}
+
+// Repair checks every chunk and parity chunk of the erasure coded primitive
+// with id p.Id, hidden or not, and writes back any that are missing or
+// damaged, rebuilt from the rest of their stripe. It returns the number of
+// chunks written.
+func (p *Primitive) Repair() (int, error) {
+	defer timeTrack(time.Now(), "primitive.Repair")
+	var repaired int
+	err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		repaired = 0
+		// primitives in the trash are repaired too, as they may be restored
+		if err := p.readMeta(txn); err != nil {
+			return err
+		}
+		if p.Erasure == nil || p.Stripes == nil {
+			return nil
+		}
+		rs, err := newReedSolomon(p.Erasure.Data, p.Erasure.Parity)
+		if err != nil {
+			return err
+		}
+		d := p.Erasure.Data
+		for s := range p.Stripes {
+			shards, lost, err := p.readStripe(txn, s)
+			if err != nil {
+				return err
+			}
+			if len(lost) == 0 {
+				continue
+			}
+			if err := rs.reconstruct(shards); err != nil {
+				return errors.New(fmt.Sprintf("stripe %d of %s can't be rebuilt: %s", s, p.Id, err))
+			}
+			for _, i := range lost {
+				ref, buf := "", shards[i]
+				if i < d {
+					ref, buf = p.ref(s*d+i), buf[:p.size(s*d+i)]
+				} else {
+					ref = p.Stripes[s].Parity[i-d]
+				}
+				// written in place, as other primitives may share it
+				value, err := p.encode(ref, buf)
+				if err != nil {
+					return err
+				}
+				if err := p.ns().putStored(txn, p.Tier, ref, value); err != nil {
+					return err
+				}
+				repaired = repaired + 1
+			}
+		}
+		return nil
+	})
+	return repaired, err
+}
+
+// RepairAll repairs every erasure coded primitive of the default tenant,
+// returning the number of chunks written
+func RepairAll() (int, error) {
+	return defaultTenant.RepairAll()
+}
+
+// RepairAll repairs every erasure coded primitive of t, returning the
+// number of chunks written. Primitives that can't be repaired are reported
+// together once the rest are done.
+func (t *Tenant) RepairAll() (int, error) {
+	defer timeTrack(time.Now(), "RepairAll")
+	var repaired int
+	var failed []string
+	start := proto.Key(t.metaDb)
+	end := start.PrefixEnd()
+	for {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return repaired, err
+		}
+		for _, row := range rows {
+			var p Primitive
+			var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+			if err := dec.Decode(&p); err != nil {
+				return repaired, err
+			}
+			p.Tenant = t.Name
+			if p.Erasure == nil {
+				continue
+			}
+			n, err := p.Repair()
+			repaired = repaired + n
+			if err != nil && err != NOT_FOUND {
+				failed = append(failed, fmt.Sprintf("%s: %s", p.Id, err))
+			}
+		}
+		if len(rows) < 100 {
+			break
+		}
+		start = rows[len(rows)-1].Key.Next()
+	}
+	if len(failed) > 0 {
+		return repaired, errors.New(fmt.Sprintf("%d primitives couldn't be repaired: %v", len(failed), failed))
+	}
+	return repaired, nil
+}
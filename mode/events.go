@@ -0,0 +1,243 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/ugorji/go/codec"
+	"sync"
+	"time"
+)
+
+// With Options.Events set, every change to a primitive is recorded as an
+// event in the feed, in the same transaction as the change. Events are
+// numbered in the order their transactions commit, so a consumer can read
+// on from the last one it handled. Changes that only move chunks, such as
+// compaction, key rotation or tiering, are not recorded.
+//
+// A primitive put in the trash is deleted as far as the feed is concerned,
+// and created again if it is restored. An expired primitive is reported
+// once, when it is swept.
+
+// Kinds of event
+const (
+	EVENT_CREATE = "create"
+	EVENT_UPDATE = "update"
+	EVENT_DELETE = "delete"
+	EVENT_EXPIRE = "expire"
+)
+
+// Event is a change to the primitive with id Id. Name, MimeType and Length
+// are those of the primitive after the change, or before a delete.
+type Event struct {
+	Seq      int64  `json:"seq"`
+	Type     string `json:"type"`
+	Id       string `json:"id"`
+	Time     string `json:"time"`
+	Name     string `json:"name,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+	Length   int    `json:"length"`
+}
+
+func (t *Tenant) eventKey(seq int64) proto.Key {
+	return proto.Key(fmt.Sprintf("%s%020d", t.eventDb, seq))
+}
+
+func (t *Tenant) eventSeqKey() proto.Key {
+	return proto.Key(t.pdb + "eventSeq")
+}
+
+// emit records an event of kind about p
+func (p *Primitive) emit(kv *client.KV, kind string) error {
+	incResp := &proto.IncrementResponse{}
+	if err := kv.Call(proto.Increment, proto.IncrementArgs(p.ns().eventSeqKey(), 1), incResp); err != nil {
+		return err
+	}
+	e := &Event{
+		Seq:      incResp.NewValue,
+		Type:     kind,
+		Id:       p.Id,
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Name:     p.Name,
+		MimeType: p.MimeType,
+		Length:   p.Length,
+	}
+	return putRecord(kv, p.ns().eventKey(e.Seq), e)
+}
+
+// emitChange records the change from old, as stored before, to p
+func (p *Primitive) emitChange(kv *client.KV, old *Primitive) error {
+	if !p.ns().opts().Events {
+		return nil
+	}
+	now := time.Now()
+	was := old.Id != "" && !old.hidden(now)
+	is := !p.hidden(now)
+	switch {
+	case !was && is:
+		return p.emit(kv, EVENT_CREATE)
+	case was && !is && p.Trashed != "":
+		return old.emit(kv, EVENT_DELETE)
+	case was && is && p.changedFrom(old):
+		return p.emit(kv, EVENT_UPDATE)
+	}
+	return nil
+}
+
+// emitEnd records the destruction of old, as stored before
+func (p *Primitive) emitEnd(kv *client.KV, old *Primitive) error {
+	if !p.ns().opts().Events || old.Id == "" || old.Trashed != "" {
+		return nil
+	}
+	if old.expired(time.Now()) {
+		return old.emit(kv, EVENT_EXPIRE)
+	}
+	return old.emit(kv, EVENT_DELETE)
+}
+
+// changedFrom reports whether p differs from old in anything a consumer
+// of the feed can see
+func (p *Primitive) changedFrom(old *Primitive) bool {
+	return p.Name != old.Name || p.MimeType != old.MimeType || p.Length != old.Length ||
+		p.Sha256 != old.Sha256 || p.Expires != old.Expires || p.Retain != old.Retain || p.Hold != old.Hold
+}
+
+// ReadEvents returns up to max events of the default tenant following the
+// one numbered after, or from the first if after is 0
+func ReadEvents(after int64, max int) ([]Event, error) {
+	return defaultTenant.ReadEvents(after, max)
+}
+
+// TrimEvents deletes the events of the default tenant up to and including
+// the one numbered upTo
+func TrimEvents(upTo int64) error {
+	return defaultTenant.TrimEvents(upTo)
+}
+
+// Subscribe delivers the events of the default tenant following the one
+// numbered after, checking for new ones every interval
+func Subscribe(after int64, every time.Duration) *Subscription {
+	return defaultTenant.Subscribe(after, every)
+}
+
+// ReadEvents returns up to max events of t following the one numbered
+// after, or from the first if after is 0
+func (t *Tenant) ReadEvents(after int64, max int) ([]Event, error) {
+	rows, err := scan(kvClient, t.eventKey(after+1), proto.Key(t.eventDb).PrefixEnd(), int64(max))
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(rows))
+	for _, row := range rows {
+		var e Event
+		var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+		if err := dec.Decode(&e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// TrimEvents deletes the events of t up to and including the one numbered
+// upTo, once every consumer has read past it
+func (t *Tenant) TrimEvents(upTo int64) error {
+	delReq := &proto.DeleteRangeRequest{}
+	delReq.Key = proto.Key(t.eventDb)
+	delReq.EndKey = t.eventKey(upTo + 1)
+	return kvClient.Call(proto.DeleteRange, delReq, &proto.DeleteRangeResponse{})
+}
+
+// Subscription delivers events from the feed on C as they are recorded
+type Subscription struct {
+	C <-chan Event
+
+	c    chan Event
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	err  error
+}
+
+// Subscribe delivers the events of t following the one numbered after, or
+// every event if after is 0, checking for new ones every interval once it
+// has caught up. C is closed when the subscription is closed, or if
+// reading the feed fails, when Err says why.
+func (t *Tenant) Subscribe(after int64, every time.Duration) *Subscription {
+	s := &Subscription{c: make(chan Event), done: make(chan struct{})}
+	s.C = s.c
+	s.wg.Add(1)
+	go s.run(t, after, every)
+	return s
+}
+
+func (s *Subscription) run(t *Tenant, after int64, every time.Duration) {
+	defer s.wg.Done()
+	defer close(s.c)
+	for {
+		events, err := t.ReadEvents(after, 100)
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+		for _, e := range events {
+			select {
+			case s.c <- e:
+				after = e.Seq
+			case <-s.done:
+				return
+			}
+		}
+		if len(events) == 100 {
+			continue
+		}
+		select {
+		case <-time.After(every):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Close stops the subscription. It may be called more than once, and
+// from more than one goroutine.
+func (s *Subscription) Close() {
+	s.once.Do(func() { close(s.done) })
+	s.wg.Wait()
+}
+
+// Err returns the error that ended the subscription, if any
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
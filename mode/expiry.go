@@ -0,0 +1,144 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"strings"
+	"time"
+)
+
+// A primitive made with Expires set is gone from that time on: it is not
+// found by any operation, and SweepExpired destroys it and frees its
+// chunks. A locked primitive does not expire until it is released.
+// Primitives are indexed by expiry time, so the sweep need only look at
+// those that have expired.
+
+// ExpireIn sets p, before it is made, to expire once ttl has passed
+func (p *Primitive) ExpireIn(ttl time.Duration) {
+	p.Expires = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+}
+
+// normalizeExpiry checks Expires and puts it in UTC, so the expiry index
+// sorts by time
+func (p *Primitive) normalizeExpiry() error {
+	if p.Expires == "" {
+		return nil
+	}
+	expires, err := time.Parse(time.RFC3339, p.Expires)
+	if err != nil {
+		return err
+	}
+	p.Expires = expires.UTC().Format(time.RFC3339)
+	return nil
+}
+
+// expired reports whether p has expired by now
+func (p *Primitive) expired(now time.Time) bool {
+	if p.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339, p.Expires)
+	return err == nil && !now.Before(expires)
+}
+
+// expiryKey separates the time from the id with a character that sorts
+// after any in the time
+func (p *Primitive) expiryKey() proto.Key {
+	return proto.Key(p.ns().expiryDb + p.Expires + "|" + p.Id)
+}
+
+// indexExpiry moves the expiry index entry of p from that of old
+func (p *Primitive) indexExpiry(kv *client.KV, old *Primitive) error {
+	if old.Expires == p.Expires {
+		return nil
+	}
+	if old.Expires != "" {
+		delReq := &proto.DeleteRequest{}
+		delReq.Key = old.expiryKey()
+		if err := kv.Call(proto.Delete, delReq, &proto.DeleteResponse{}); err != nil {
+			return err
+		}
+	}
+	if p.Expires == "" {
+		return nil
+	}
+	putResp := &proto.PutResponse{}
+	return kv.Call(proto.Put, proto.PutArgs(p.expiryKey(), []byte(p.Id)), putResp)
+}
+
+// SweepExpired destroys every primitive of the default tenant that has
+// expired, returning the number destroyed
+func SweepExpired() (int, error) {
+	return defaultTenant.SweepExpired()
+}
+
+// SweepExpired destroys every primitive of t that has expired, returning
+// the number destroyed
+func (t *Tenant) SweepExpired() (int, error) {
+	defer timeTrack(time.Now(), "SweepExpired")
+	var swept int
+	now := time.Now()
+	start := proto.Key(t.expiryDb)
+	end := proto.Key(t.expiryDb + now.UTC().Format(time.RFC3339) + "|").PrefixEnd()
+	for {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return swept, err
+		}
+		if len(rows) == 0 {
+			return swept, nil
+		}
+		for _, row := range rows {
+			start = row.Key.Next()
+			p := &Primitive{Id: string(row.Key)[strings.LastIndex(string(row.Key), "|")+1:], Tenant: t.Name}
+			err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+				return p.sweep(txn, now)
+			})
+			if err == NOT_FOUND || err == LOCKED {
+				continue
+			} else if err != nil {
+				return swept, err
+			}
+			p.audit(AUDIT_EXPIRE, p.Length, nil)
+			swept = swept + 1
+		}
+	}
+}
+
+// sweep destroys the primitive with id p.Id if it has expired by now
+func (p *Primitive) sweep(txn *client.KV, now time.Time) error {
+	if err := p.readMeta(txn); err != nil {
+		return err
+	}
+	// it may have been given a later expiry since the scan
+	if !p.expired(now) {
+		return NOT_FOUND
+	}
+	return p.destroy(txn)
+}
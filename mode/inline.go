@@ -0,0 +1,95 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"github.com/cockroachdb/cockroach/client"
+)
+
+// Primitives of up to Options.Inline bytes are made with their contents in
+// the meta data, so a single Get reads both. The contents are compressed
+// and encrypted as a chunk would be, and read as the one chunk of the
+// primitive, so readers need not know the difference. Inline contents are
+// only ever made by Make; the first write moves them out into a chunk.
+
+// inlineRef stands in for a chunk key when sealing inline contents. It
+// names no primitive, as clones copy inline contents under their own ids.
+const inlineRef = "inline"
+
+// putInline stores buf as the contents of p in p.Data
+func (p *Primitive) putInline(buf []byte) error {
+	var err error
+	p.Data, err = p.encode(inlineRef, buf)
+	p.Chunks = 1
+	return err
+}
+
+// spill moves inline or packed contents out into a chunk of their own, so
+// that p can be written like any other primitive
+func (p *Primitive) spill(txn *client.KV) error {
+	if p.Data == nil && p.Pack == "" {
+		return nil
+	}
+	buf, err := p.getChunk(txn, 0)
+	if err != nil {
+		return err
+	}
+	p.Data = nil
+	if p.Pack != "" {
+		if err := p.leavePack(txn); err != nil {
+			return err
+		}
+	}
+	ref, err := p.putChunk(txn, chunkRef(p.Id, 0), buf)
+	if err != nil {
+		return err
+	}
+	if p.Dedup || p.Tier != "" {
+		p.Refs = []string{ref}
+	}
+	if p.Chunking != nil {
+		p.Sizes = []int{len(buf)}
+	}
+	return nil
+}
+
+// releaseChunks releases every chunk of p, of which inline contents have
+// none, and packed contents only their place in the pack
+func (p *Primitive) releaseChunks(kv *client.KV) error {
+	if p.Data != nil {
+		return nil
+	}
+	if p.Pack != "" {
+		return p.leavePack(kv)
+	}
+	for i := 0; i < p.Chunks; i++ {
+		if err := p.ns().releaseChunk(kv, p.Tier, p.ref(i)); err != nil {
+			return err
+		}
+	}
+	return p.releaseParity(kv, 0)
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/ugorji/go/codec"
+	"strings"
+	"time"
+)
+
+// Lifecycle rules say what becomes of primitives as they age. Each rule
+// selects primitives by name, mime type, age and size, and names an
+// action to take on them:
+//
+//	expire    destroy the primitive
+//	compress  rewrite its chunks with Codec, "" to store them uncompressed
+//	tier      move its chunks to Tier, "" to move them into cockroach
+//	prune     destroy all but the newest Keep of its revisions
+//
+// Rules are applied in order, and a primitive a rule expires is not seen
+// by the rules after it. Actions a primitive already satisfies are skipped.
+type Rule struct {
+	Prefix   string `json:"prefix,omitempty"`   // names starting with this, "" for any
+	MimeType string `json:"mimeType,omitempty"` // this mime type, or every type under one ending in "/"
+	Days     int    `json:"days,omitempty"`     // created at least this many days ago
+	Size     int    `json:"size,omitempty"`     // of at least this many bytes
+	Action   string `json:"action"`             // expire, compress, tier or prune
+	Codec    string `json:"codec,omitempty"`    // codec to compress with
+	Tier     string `json:"tier,omitempty"`     // tier to move to
+	Keep     int    `json:"keep,omitempty"`     // revisions to keep
+}
+
+// LifecycleAction reports an action taken, or in a dry run one that would
+// have been, on a primitive by the rule with index Rule
+type LifecycleAction struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Rule   int    `json:"rule"`
+	Action string `json:"action"`
+}
+
+// validate checks that the action of r can be carried out
+func (r *Rule) validate() error {
+	switch r.Action {
+	case "expire":
+	case "compress":
+		if _, ok := codecs[r.Codec]; r.Codec != "" && !ok {
+			return errors.New(fmt.Sprintf("unknown codec %s", r.Codec))
+		}
+	case "tier":
+		if _, ok := tiers[r.Tier]; r.Tier != "" && !ok {
+			return errors.New(fmt.Sprintf("unknown tier %s", r.Tier))
+		}
+	case "prune":
+		if r.Keep < 0 {
+			return errors.New(fmt.Sprintf("negative number of revisions %d", r.Keep))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown lifecycle action %q", r.Action))
+	}
+	return nil
+}
+
+// matches reports whether r selects p and p does not already satisfy it.
+// Primitives without a creation date are never old enough.
+func (r *Rule) matches(p *Primitive, now time.Time) bool {
+	if !strings.HasPrefix(p.Name, r.Prefix) || p.Length < r.Size {
+		return false
+	}
+	if r.MimeType != "" && p.MimeType != r.MimeType &&
+		!(strings.HasSuffix(r.MimeType, "/") && strings.HasPrefix(p.MimeType, r.MimeType)) {
+		return false
+	}
+	if r.Days > 0 {
+		created, err := time.Parse(time.RFC3339, p.Created)
+		if err != nil || now.Sub(created) < time.Duration(r.Days)*24*time.Hour {
+			return false
+		}
+	}
+	switch r.Action {
+	case "expire":
+		return !p.locked(now)
+	case "compress":
+		return p.Codec != r.Codec
+	case "tier":
+		return p.Tier != r.Tier
+	case "prune":
+		return p.Revs > r.Keep && !p.locked(now)
+	}
+	return true
+}
+
+// apply carries out the action of r on the primitive with id p.Id
+func (r *Rule) apply(p *Primitive) error {
+	switch r.Action {
+	case "expire":
+		return p.Destroy()
+	case "compress":
+		return p.Recompress(r.Codec)
+	case "tier":
+		return p.MoveTier(r.Tier)
+	case "prune":
+		_, err := p.PruneRevisions(r.Keep)
+		return err
+	}
+	return nil
+}
+
+// RunLifecycle applies the rules to every primitive of the default tenant,
+// returning the actions taken
+func RunLifecycle(rules []Rule, dryRun bool) ([]LifecycleAction, error) {
+	return defaultTenant.RunLifecycle(rules, dryRun)
+}
+
+// RunLifecycle applies the rules to every primitive of t, returning the
+// actions taken. With dryRun set nothing is changed, and the actions that
+// would have been taken are returned. Primitives whose action fails are
+// reported together once the rest are done.
+func (t *Tenant) RunLifecycle(rules []Rule, dryRun bool) ([]LifecycleAction, error) {
+	defer timeTrack(time.Now(), "RunLifecycle")
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, errors.New(fmt.Sprintf("rule %d: %s", i, err))
+		}
+	}
+	var actions []LifecycleAction
+	var failed []string
+	now := time.Now()
+	start := proto.Key(t.metaDb)
+	end := start.PrefixEnd()
+	for {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return actions, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			start = row.Key.Next()
+			var p Primitive
+			var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+			if err := dec.Decode(&p); err != nil {
+				return actions, err
+			}
+			p.Tenant = t.Name
+			if p.hidden(now) {
+				continue
+			}
+			for i := range rules {
+				r := &rules[i]
+				if !r.matches(&p, now) {
+					continue
+				}
+				if !dryRun {
+					if err := r.apply(&p); err != nil {
+						failed = append(failed, p.Id)
+						break
+					}
+				}
+				actions = append(actions, LifecycleAction{Id: p.Id, Name: p.Name, Rule: i, Action: r.Action})
+				if r.Action == "expire" {
+					break
+				}
+				// later rules see the primitive as the action left it
+				switch r.Action {
+				case "compress":
+					p.Codec = r.Codec
+				case "tier":
+					p.Tier = r.Tier
+				case "prune":
+					p.Revs = r.Keep
+				}
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return actions, errors.New(fmt.Sprintf("%d primitives failed their lifecycle actions: %v", len(failed), failed))
+	}
+	return actions, nil
+}
+
+// Recompress rewrites the chunks of the primitive with id p.Id compressed
+// with the named codec, or uncompressed if name is "". Chunks shared with
+// clones are copied, as the clones keep their codec.
+func (p *Primitive) Recompress(name string) error {
+	defer timeTrack(time.Now(), "primitive.Recompress")
+	if _, ok := codecs[name]; name != "" && !ok {
+		return errors.New(fmt.Sprintf("unknown codec %s", name))
+	}
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.getMeta(txn); err != nil {
+			return err
+		}
+		if err := p.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if p.Codec == name {
+			return nil
+		}
+		err := p.rewrite(txn, func() error {
+			p.Codec = name
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return p.putMeta(txn)
+	})
+}
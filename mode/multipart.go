@@ -0,0 +1,349 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/twinj/uuid"
+	"github.com/ugorji/go/codec"
+	"hash"
+	"io"
+	"time"
+)
+
+// Highest part number a multipart upload accepts
+const MAX_PARTS = 10000
+
+// Multipart is an upload whose parts are sent independently, in any order
+// and concurrently, and then completed into a single Primitive. Each part
+// is written as its own run of chunks under the id the primitive will have,
+// so completing moves no data. The upload is stored in the
+// datamode.Primitive.Multipart subspace, each part under the upload.
+//
+// Completing reads no data either, so the digests of the primitive are
+// made from those of its parts as S3 makes its ETags: the hash of the
+// hashes of the parts, followed by "-" and the number of parts. Such a
+// primitive is only ever found identical to one uploaded in the same parts.
+//
+// Like a Session, an upload is checked against the owner and access
+// control list of its primitive: uploading and listing its parts, and
+// completing it, need write permission, aborting it delete permission.
+type Multipart struct {
+	Id        string    `json:"id"`        // UUID of the upload, and of the primitive it becomes
+	Primitive Primitive `json:"primitive"` // the primitive to be, empty, but set up for storing the parts
+
+	Actor  string   `json:"-" codec:"-"` // who operations on the upload are done for, not stored
+	Groups []string `json:"-" codec:"-"` // groups the actor is a member of, not stored
+	Tenant string   `json:"-" codec:"-"` // name of the tenant the upload belongs to, not stored
+}
+
+// Part is one uploaded part of a Multipart
+type Part struct {
+	Number int      `json:"number"`
+	Length int      `json:"length"`
+	Md5    string   `json:"md5"`
+	Sha256 string   `json:"sha256"`
+	Refs   []string `json:"-" codec:"refs"` // keys of the part's chunks, less the primitive prefix
+}
+
+// StartMultipart begins a multipart upload of a new primitive, taking Name,
+// MimeType, Expires, Owner and ACL from p, the owner defaulting to p.Actor
+func (p *Primitive) StartMultipart() (*Multipart, error) {
+	m := &Multipart{Id: uuid.NewV4().String(), Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+	m.Primitive = Primitive{Name: p.Name, MimeType: p.MimeType, Created: time.Now().UTC().Format(time.RFC3339), Expires: p.Expires,
+		Owner: p.Owner, ACL: p.ACL, Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+	if err := m.Primitive.prepare(m.Id); err != nil {
+		return nil, err
+	}
+	if err := putRecord(kvClient, m.key(), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UploadPart writes length bytes from the reader as part number, which
+// must be between 1 and MAX_PARTS. Uploading a part number again replaces
+// the earlier part.
+func (m *Multipart) UploadPart(number int, reader *bufio.Reader, length int) (*Part, error) {
+	defer timeTrack(time.Now(), "multipart.UploadPart")
+	if number < 1 || number > MAX_PARTS {
+		return nil, errors.New(fmt.Sprintf("part number %d out of range", number))
+	}
+	if length <= 0 {
+		return nil, MISSING_ARG
+	}
+	part := &Part{Number: number, Length: length}
+	e := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := m.get(txn); err != nil {
+			return err
+		}
+		if err := m.Primitive.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		// release the part being replaced first, as the new one reuses
+		// its chunk keys
+		var old Part
+		err := getRecord(txn, m.partKey(number), &old)
+		if err == nil {
+			if err := old.release(txn, &m.Primitive); err != nil {
+				return err
+			}
+		} else if err != NOT_FOUND {
+			return err
+		}
+
+		digest := newDigest()
+		buf := make([]byte, m.Primitive.CSize)
+		owner := m.Primitive
+		part.Refs = nil
+		for numBytes := 0; numBytes < length; {
+			n := m.Primitive.CSize
+			if length-numBytes < n {
+				n = length - numBytes
+			}
+			readOffset, err := io.ReadFull(reader, buf[:n])
+			numBytes = numBytes + readOffset
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return errors.New(fmt.Sprintf("bytes read %d doesn't match expected %d", numBytes, length))
+			} else if err != nil {
+				return err
+			}
+			ref, err := owner.putChunk(txn, fmt.Sprintf("%s:%10d:%10d", m.Id, number, len(part.Refs)), buf[:n])
+			if err != nil {
+				return err
+			}
+			digest.Write(buf[:n])
+			part.Refs = append(part.Refs, ref)
+		}
+		part.Md5 = hex.EncodeToString(digest.md5.Sum(nil))
+		part.Sha256 = hex.EncodeToString(digest.sha256.Sum(nil))
+		return putRecord(txn, m.partKey(number), part)
+	})
+	if e != nil {
+		return nil, e
+	}
+	return part, nil
+}
+
+// ListParts returns the parts uploaded so far, in part number order
+func (m *Multipart) ListParts() ([]Part, error) {
+	if err := m.get(kvClient); err != nil {
+		return nil, err
+	}
+	if err := m.Primitive.allow(PERM_WRITE); err != nil {
+		return nil, err
+	}
+	return m.parts(kvClient)
+}
+
+// Complete finishes the upload, making a Primitive from the parts with the
+// given numbers, which must be in ascending order. Parts not listed are
+// discarded. The upload no longer exists afterwards.
+func (m *Multipart) Complete(numbers []int) (*Primitive, error) {
+	defer timeTrack(time.Now(), "multipart.Complete")
+	if len(numbers) == 0 {
+		return nil, MISSING_ARG
+	}
+	p := new(Primitive)
+	e := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := m.get(txn); err != nil {
+			return err
+		}
+		if err := m.Primitive.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		parts, err := m.parts(txn)
+		if err != nil {
+			return err
+		}
+		byNumber := make(map[int]Part)
+		for _, part := range parts {
+			byNumber[part.Number] = part
+		}
+		*p = m.Primitive
+		p.Refs = []string{}
+		p.Sizes = []int{}
+		md5s, shas := md5.New(), sha256.New()
+		// parts uploaded before their sha256 was kept leave the digest
+		// stale, for Rehash
+		stale := false
+		for i, number := range numbers {
+			if i > 0 && number <= numbers[i-1] {
+				return errors.New(fmt.Sprintf("part %d out of order", number))
+			}
+			part, ok := byNumber[number]
+			if !ok {
+				return PART_NOT_FOUND
+			}
+			delete(byNumber, number)
+			for j, ref := range part.Refs {
+				size := m.Primitive.CSize
+				if j == len(part.Refs)-1 {
+					size = part.Length - j*m.Primitive.CSize
+				}
+				p.Refs = append(p.Refs, ref)
+				p.Sizes = append(p.Sizes, size)
+			}
+			p.Chunks = p.Chunks + len(part.Refs)
+			p.Length = p.Length + part.Length
+			if err := sumPart(md5s, part.Md5); err != nil {
+				return err
+			}
+			if err := sumPart(shas, part.Sha256); err != nil {
+				return err
+			}
+			stale = stale || part.Sha256 == ""
+		}
+		for _, part := range byNumber {
+			if err := part.release(txn, &m.Primitive); err != nil {
+				return err
+			}
+		}
+		if err := m.del(txn); err != nil {
+			return err
+		}
+		if !stale {
+			p.Md5 = fmt.Sprintf("%x-%d", md5s.Sum(nil), len(numbers))
+			p.Sha256 = fmt.Sprintf("%x-%d", shas.Sum(nil), len(numbers))
+		}
+		return p.putMeta(txn)
+	})
+	if e != nil {
+		return nil, (&Primitive{Id: m.Id, Actor: m.Actor, Tenant: m.Tenant}).audit(AUDIT_MAKE, 0, e)
+	}
+	return p, p.audit(AUDIT_MAKE, p.Length, nil)
+}
+
+// Abort discards the upload and every part uploaded to it
+func (m *Multipart) Abort() error {
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := m.get(txn); err != nil {
+			return err
+		}
+		if err := m.Primitive.allow(PERM_DELETE); err != nil {
+			return err
+		}
+		parts, err := m.parts(txn)
+		if err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if err := part.release(txn, &m.Primitive); err != nil {
+				return err
+			}
+		}
+		return m.del(txn)
+	})
+}
+
+// sumPart adds a digest of a part, in hex, to h
+func sumPart(h hash.Hash, digest string) error {
+	b, err := hex.DecodeString(digest)
+	if err != nil {
+		return err
+	}
+	h.Write(b)
+	return nil
+}
+
+func (m *Multipart) key() proto.Key {
+	return proto.Key(tenantNamed(m.Tenant).multipartDb + m.Id)
+}
+
+func (m *Multipart) partKey(number int) proto.Key {
+	return proto.Key(fmt.Sprintf("%s:%10d", m.key(), number))
+}
+
+// parts returns every part of the upload, in part number order
+func (m *Multipart) parts(kv *client.KV) ([]Part, error) {
+	var parts []Part
+	start := proto.Key(string(m.key()) + ":")
+	end := start.PrefixEnd()
+	for {
+		rows, err := scan(kv, start, end, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			var part Part
+			var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+			if err := dec.Decode(&part); err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		}
+		if len(rows) < 1000 {
+			return parts, nil
+		}
+		start = rows[len(rows)-1].Key.Next()
+	}
+}
+
+// get reloads the upload, returning UPLOAD_NOT_FOUND once it has been
+// completed or aborted
+func (m *Multipart) get(kv *client.KV) error {
+	if m.Id == "" || len(m.Id) != 32 {
+		return errors.New(fmt.Sprintf("Invalid upload id:%s", m.Id))
+	}
+	var upload Multipart
+	err := getRecord(kv, m.key(), &upload)
+	if err == NOT_FOUND {
+		return UPLOAD_NOT_FOUND
+	} else if err != nil {
+		return err
+	}
+	upload.Actor, upload.Groups, upload.Tenant = m.Actor, m.Groups, m.Tenant
+	upload.Primitive.Actor, upload.Primitive.Groups, upload.Primitive.Tenant = m.Actor, m.Groups, m.Tenant
+	*m = upload
+	return nil
+}
+
+// del deletes the upload record and its part records, but not the chunks
+func (m *Multipart) del(txn *client.KV) error {
+	delReq := &proto.DeleteRangeRequest{}
+	delReq.Key = m.key()
+	delReq.EndKey = proto.Key(string(m.key()) + ":").PrefixEnd()
+	delResp := &proto.DeleteRangeResponse{}
+	return txn.Call(proto.DeleteRange, delReq, delResp)
+}
+
+// release deletes the chunks of the part, stored like those of owner
+func (part *Part) release(txn *client.KV, owner *Primitive) error {
+	for _, ref := range part.Refs {
+		if err := owner.ns().releaseChunk(txn, owner.Tier, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/twinj/uuid"
+	"sort"
+	"time"
+)
+
+// Primitives of up to Options.Pack bytes are packed together, their
+// contents appended one after another to a shared pack of up to PACK_SIZE
+// bytes, so that many small files cost a single key. The meta data of a
+// packed primitive holds the pack and the offset and length of its
+// contents within it, which are compressed and encrypted as a chunk would
+// be and read as the one chunk of the primitive. The contents of deleted
+// primitives stay in their pack until CompactPacks rewrites it.
+//
+// Packs are stored in the datamode.Primitive.Pack subspace, with a record
+// of the primitives in each, and their contents in the
+// datamode.Primitive.PackData subspace. A pack is never rewritten in place:
+// compacting moves the live contents to another pack and deletes the old
+// one, so a reader caught in between finds it gone and reports CHANGED.
+//
+// Each writer, a process using this package, fills a pack of its own, so
+// writers packing files at the same time don't contend for one pack.
+const PACK_SIZE = CHUNK_SIZE
+
+// How long a pack may go unfilled before CompactPacks takes it to be
+// abandoned by its writer, and no longer open
+var PACK_IDLE = time.Hour
+
+// packWriter names this process among the writers filling packs
+var packWriter = uuid.NewV4().String()
+
+// packedRef stands in for a chunk key when sealing packed contents, which
+// move between packs without being decrypted
+const packedRef = "packed"
+
+// pack is the record of a pack
+type pack struct {
+	Id      string                `json:"id"`
+	Size    int                   `json:"size"`    // bytes written to the pack
+	Members map[string]packMember `json:"members"` // by primitive id
+	Writer  string                `json:"writer"`  // writer that filled the pack
+
+	t *Tenant // the tenant the pack belongs to, not stored
+}
+
+// openPack is the record of the pack a writer is filling
+type openPack struct {
+	Id   string `json:"id"`
+	Time string `json:"time"` // when the pack was last filled
+}
+
+// idle reports whether the pack hasn't been filled for PACK_IDLE by now
+func (o *openPack) idle(now time.Time) bool {
+	filled, err := time.Parse(time.RFC3339Nano, o.Time)
+	return err != nil || !now.Before(filled.Add(PACK_IDLE))
+}
+
+// packMember locates the contents of a primitive in its pack. Clones of a
+// packed primitive are members in their own right, sharing its contents.
+type packMember struct {
+	Off int `json:"off"`
+	Len int `json:"len"`
+}
+
+// putPacked stores buf as the contents of p in the open pack
+func (p *Primitive) putPacked(txn *client.KV, buf []byte) error {
+	value, err := p.encode(packedRef, buf)
+	if err != nil {
+		return err
+	}
+	pk, err := p.ns().openPack(txn, len(value))
+	if err != nil {
+		return err
+	}
+	off, err := pk.append(txn, value)
+	if err != nil {
+		return err
+	}
+	if err := p.ns().joinPack(txn, pk.Id, p.Id, packMember{Off: off, Len: len(value)}); err != nil {
+		return err
+	}
+	p.Pack, p.PackOff, p.PackLen = pk.Id, off, len(value)
+	p.Chunks = 1
+	return nil
+}
+
+// getPacked reads the contents of p from its pack
+func (p *Primitive) getPacked(kv *client.KV) ([]byte, error) {
+	getResp := &proto.GetResponse{}
+	if err := kv.Call(proto.Get, proto.GetArgs(p.ns().packDataKey(p.Pack)), getResp); err != nil {
+		return nil, err
+	}
+	if getResp.Value == nil || len(getResp.Value.Bytes) < p.PackOff+p.PackLen {
+		return nil, errChunkMissing
+	}
+	return p.decode(packedRef, getResp.Value.Bytes[p.PackOff:p.PackOff+p.PackLen])
+}
+
+// leavePack removes p from its pack, deleting the pack once it is empty
+func (p *Primitive) leavePack(kv *client.KV) error {
+	pk := &pack{t: p.ns()}
+	err := getRecord(kv, pk.t.packKey(p.Pack), pk)
+	if err == NOT_FOUND {
+		p.Pack = ""
+		return nil
+	} else if err != nil {
+		return err
+	}
+	delete(pk.Members, p.Id)
+	p.Pack, p.PackOff, p.PackLen = "", 0, 0
+	if len(pk.Members) > 0 {
+		return putRecord(kv, pk.t.packKey(pk.Id), pk)
+	}
+	return pk.del(kv)
+}
+
+// sharePacked makes p, a clone of source, a member of the pack of source
+func (p *Primitive) sharePacked(txn *client.KV, source *Primitive) error {
+	return p.ns().joinPack(txn, source.Pack, p.Id, packMember{Off: source.PackOff, Len: source.PackLen})
+}
+
+// openPack returns the pack of t this writer is filling, or starts a new
+// one if there is none or it hasn't room for n more bytes
+func (t *Tenant) openPack(txn *client.KV, n int) (*pack, error) {
+	open := &openPack{}
+	err := getRecord(txn, t.openPackKey(packWriter), open)
+	if err != nil && err != NOT_FOUND {
+		return nil, err
+	}
+	pk := &pack{t: t}
+	if err == nil {
+		err = getRecord(txn, t.packKey(open.Id), pk)
+		if err == nil && pk.Size+n <= PACK_SIZE {
+			open.Time = time.Now().UTC().Format(time.RFC3339Nano)
+			return pk, putRecord(txn, t.openPackKey(packWriter), open)
+		} else if err != nil && err != NOT_FOUND {
+			return nil, err
+		}
+	}
+	pk = &pack{Id: uuid.NewV4().String(), Members: make(map[string]packMember), Writer: packWriter, t: t}
+	open = &openPack{Id: pk.Id, Time: time.Now().UTC().Format(time.RFC3339Nano)}
+	return pk, putRecord(txn, t.openPackKey(packWriter), open)
+}
+
+// append adds value to the end of the pack and stores the pack record,
+// returning the offset of value
+func (pk *pack) append(txn *client.KV, value []byte) (int, error) {
+	getResp := &proto.GetResponse{}
+	if err := txn.Call(proto.Get, proto.GetArgs(pk.t.packDataKey(pk.Id)), getResp); err != nil {
+		return 0, err
+	}
+	var data []byte
+	if getResp.Value != nil {
+		data = getResp.Value.Bytes
+	}
+	off := len(data)
+	data = append(data, value...)
+	putResp := &proto.PutResponse{}
+	if err := txn.Call(proto.Put, proto.PutArgs(pk.t.packDataKey(pk.Id), data), putResp); err != nil {
+		return 0, err
+	}
+	pk.Size = len(data)
+	return off, putRecord(txn, pk.t.packKey(pk.Id), pk)
+}
+
+// joinPack adds the primitive with the given id to a pack of t as a member
+func (t *Tenant) joinPack(txn *client.KV, packId, id string, member packMember) error {
+	pk := &pack{}
+	if err := getRecord(txn, t.packKey(packId), pk); err != nil {
+		return err
+	}
+	if pk.Members == nil {
+		pk.Members = make(map[string]packMember)
+	}
+	pk.Members[id] = member
+	return putRecord(txn, t.packKey(packId), pk)
+}
+
+// live returns the number of bytes in the pack still belonging to a member
+func (pk *pack) live() int {
+	var n int
+	seen := make(map[int]bool)
+	for _, member := range pk.Members {
+		if !seen[member.Off] {
+			seen[member.Off] = true
+			n = n + member.Len
+		}
+	}
+	return n
+}
+
+// del deletes the pack, and the record of it being filled if it is
+func (pk *pack) del(kv *client.KV) error {
+	keys := []proto.Key{pk.t.packDataKey(pk.Id), pk.t.packKey(pk.Id)}
+	open := &openPack{}
+	if err := getRecord(kv, pk.t.openPackKey(pk.Writer), open); err == nil && open.Id == pk.Id {
+		keys = append(keys, pk.t.openPackKey(pk.Writer))
+	} else if err != nil && err != NOT_FOUND {
+		return err
+	}
+	for _, key := range keys {
+		delReq := &proto.DeleteRequest{}
+		delReq.Key = key
+		if err := kv.Call(proto.Delete, delReq, &proto.DeleteResponse{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactPacks compacts the packs of the default tenant
+func CompactPacks(garbage float64) (int, error) {
+	return defaultTenant.CompactPacks(garbage)
+}
+
+// CompactPacks rewrites every pack of t of which at least the given fraction,
+// between 0 and 1, belongs to deleted primitives, moving the contents still
+// in use to the open pack and deleting the old one. Packs being filled are
+// left alone, unless they have been idle for PACK_IDLE, when their writer
+// is taken to be gone and they are closed. It returns the number of packs
+// rewritten, and is meant to be run periodically.
+func (t *Tenant) CompactPacks(garbage float64) (int, error) {
+	defer timeTrack(time.Now(), "CompactPacks")
+	if garbage <= 0 || garbage > 1 {
+		return 0, errors.New(fmt.Sprintf("garbage fraction %g out of range", garbage))
+	}
+	var compacted int
+	start := proto.Key(t.packDb)
+	end := start.PrefixEnd()
+	for {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return compacted, err
+		}
+		for _, row := range rows {
+			id := string(row.Key[len(t.packDb):])
+			if len(id) != 32 {
+				continue // the record of a pack being filled
+			}
+			var done bool
+			err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+				done = false
+				pk := &pack{t: t}
+				if err := getRecord(txn, t.packKey(id), pk); err == NOT_FOUND {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				open := &openPack{}
+				if err := getRecord(txn, t.openPackKey(pk.Writer), open); err != nil && err != NOT_FOUND {
+					return err
+				} else if err == nil && open.Id == pk.Id && open.idle(time.Now()) {
+					delReq := &proto.DeleteRequest{}
+					delReq.Key = t.openPackKey(pk.Writer)
+					if err := txn.Call(proto.Delete, delReq, &proto.DeleteResponse{}); err != nil {
+						return err
+					}
+				} else if err == nil && open.Id == pk.Id {
+					return nil
+				}
+				if pk.Size == 0 || float64(pk.Size-pk.live()) < garbage*float64(pk.Size) {
+					return nil
+				}
+				done = true
+				return pk.compact(txn)
+			})
+			if err != nil {
+				return compacted, err
+			}
+			if done {
+				compacted = compacted + 1
+			}
+		}
+		if len(rows) < 100 {
+			return compacted, nil
+		}
+		start = rows[len(rows)-1].Key.Next()
+	}
+}
+
+// compact moves the live contents of the pack to the open pack, updating
+// the meta data of its members, and deletes the pack
+func (pk *pack) compact(txn *client.KV) error {
+	getResp := &proto.GetResponse{}
+	if err := txn.Call(proto.Get, proto.GetArgs(pk.t.packDataKey(pk.Id)), getResp); err != nil {
+		return err
+	}
+	var data []byte
+	if getResp.Value != nil {
+		data = getResp.Value.Bytes
+	}
+	// members are moved in id order, and those sharing contents together
+	ids := make([]string, 0, len(pk.Members))
+	for id := range pk.Members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	movedTo := make(map[int]string)
+	moved := make(map[int]packMember)
+	for _, id := range ids {
+		member := pk.Members[id]
+		// a member whose meta data is gone has been destroyed, but one
+		// in the trash may yet be restored
+		p := &Primitive{Id: id, Tenant: pk.t.Name}
+		if err := p.readMeta(txn); err == NOT_FOUND {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if _, ok := moved[member.Off]; !ok {
+			if member.Off+member.Len > len(data) {
+				return errors.New(fmt.Sprintf("pack %s is missing the contents of %s", pk.Id, id))
+			}
+			to, err := pk.t.openPack(txn, member.Len)
+			if err != nil {
+				return err
+			}
+			off, err := to.append(txn, data[member.Off:member.Off+member.Len])
+			if err != nil {
+				return err
+			}
+			movedTo[member.Off] = to.Id
+			moved[member.Off] = packMember{Off: off, Len: member.Len}
+		}
+		if err := pk.t.joinPack(txn, movedTo[member.Off], id, moved[member.Off]); err != nil {
+			return err
+		}
+		p.Pack, p.PackOff = movedTo[member.Off], moved[member.Off].Off
+		if err := p.putMeta(txn); err != nil {
+			return err
+		}
+	}
+	return pk.del(txn)
+}
+
+func (t *Tenant) packKey(id string) proto.Key {
+	return proto.Key(t.packDb + id)
+}
+
+func (t *Tenant) packDataKey(id string) proto.Key {
+	return proto.Key(t.packDataDb + id)
+}
+
+// openPackKey is the key of the record of the pack of t the writer is
+// filling
+func (t *Tenant) openPackKey(writer string) proto.Key {
+	return proto.Key(t.packDb + "open:" + writer)
+}
@@ -28,13 +28,18 @@ package mode
 
 import (
 	"bufio"
+	"crypto/cipher"
+	"encoding"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/cockroachdb/cockroach/client"
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/twinj/uuid"
 	"github.com/ugorji/go/codec"
+	"io"
 	"os"
+	"sort"
 	"time"
 )
 
@@ -49,19 +54,47 @@ const CHUNK_SIZE = 255000
 // into the datamode.Primitive subspace. The Primitive is stored in the
 // datamode.Primitive.Meta subspace
 type Primitive struct {
-	Id       string `json:"id"` // UUID of the primitive
-	Name     string `json:"name"`
-	Length   int    `json:"length"`              // number of bytes written to database
-	CSize    int    `json:"chunkSize,omitempty"` // size of chunks in this primitive
-	Chunks   int    `json:"chunks,omitempty"`    // total number of chunks written to database
-	Created  string `json:"created,omitempty"`   // date file was created/uploaded
-	Md5      string `json:"md5,omitempty"`       // md5 hash of file for comparison checking
-	MimeType string `json:"mimeType,omitempty"`  // mime type
+	Id       string    `json:"id"` // UUID of the primitive
+	Name     string    `json:"name"`
+	Length   int       `json:"length"`              // number of bytes in the primitive, before any compression
+	CSize    int       `json:"chunkSize,omitempty"` // size of chunks in this primitive
+	Chunks   int       `json:"chunks,omitempty"`    // total number of chunks written to database
+	Created  string    `json:"created,omitempty"`   // date file was created/uploaded
+	Md5      string    `json:"md5,omitempty"`       // md5 hash of file for comparison checking, "" once a write makes it stale
+	Sha256   string    `json:"sha256,omitempty"`    // sha256 hash of file, by which identical files are found, likewise
+	MimeType string    `json:"mimeType,omitempty"`  // mime type
+	Codec    string    `json:"codec,omitempty"`     // compression codec of the chunks, if any
+	Dedup    bool      `json:"dedup,omitempty"`     // chunks are stored by content hash, shared with any identical chunk
+	Chunking *Chunking `json:"chunking,omitempty"`  // sizes of content defined chunks, nil for chunks of CSize
+	Cipher   string    `json:"cipher,omitempty"`    // encryption and nonce scheme of the chunks, if any
+	KeyId    string    `json:"keyId,omitempty"`     // master key the data key is wrapped with
+	DataKey  []byte    `json:"-" codec:"dataKey"`   // data key of the chunks, wrapped
+	Digest   []byte    `json:"-" codec:"digest"`    // running md5 state, so appends need not re-read the file
+	ShaState []byte    `json:"-" codec:"shaState"`  // running sha256 state, likewise
+	Data     []byte    `json:"-" codec:"data"`      // the contents, stored like a chunk, if stored inline
+	Pack     string    `json:"-" codec:"pack"`      // pack holding the contents, if packed
+	PackOff  int       `json:"-" codec:"packOff"`   // offset of the contents in the pack
+	PackLen  int       `json:"-" codec:"packLen"`   // length of the contents in the pack, as stored
+	Erasure  *Erasure  `json:"erasure,omitempty"`   // erasure coding of the chunks, if any
+	Tier     string    `json:"tier,omitempty"`      // tier holding the chunks, "" for cockroach
+	Expires  string    `json:"expires,omitempty"`   // time from which the primitive is gone, if ever
+	Trashed  string    `json:"trashed,omitempty"`   // time the primitive was put in the trash, if it is there
+	Retain   string    `json:"retain,omitempty"`    // time until which the primitive can't be changed or destroyed
+	Hold     bool      `json:"hold,omitempty"`      // legal hold, keeping the primitive as it is until released
+	Stripes  []Stripe  `json:"-" codec:"stripes"`   // parity of each stripe of chunks
+	Refs     []string  `json:"-" codec:"refs"`      // chunk keys, once any chunk is copied on write or shared
+	Sizes    []int     `json:"-" codec:"sizes"`     // chunk sizes, when they are not all CSize
+	Gen      int       `json:"-" codec:"gen"`       // generation, bumped by every copy-on-write
+	Revs     int       `json:"revisions,omitempty"` // earlier revisions kept, see Revisions
+	Owner    string    `json:"owner,omitempty"`     // actor the primitive was made for, who controls access to it
+	ACL      []Grant   `json:"acl,omitempty"`       // access given to others than the owner
+	Actor    string    `json:"-" codec:"-"`         // who operations on the primitive are done for, not stored
+	Groups   []string  `json:"-" codec:"-"`         // groups the actor is a member of, not stored
+	Tenant   string    `json:"-" codec:"-"`         // name of the tenant the primitive belongs to, not stored
+
+	aead cipher.AEAD // data key, unwrapped and ready for use
 }
 
-var pdb string
-var metaDb string
-
 func timeTrack(start time.Time, name string) {
 	elapsed := time.Since(start)
 	fmt.Printf("%s took %s\n", name, elapsed)
@@ -86,8 +119,8 @@ func init() {
 	// default curly braces and dashes, cutting uuid length to 32 chars
 	uuid.SwitchFormat(uuid.Clean, false)
 
-	pdb = "primitive:"
-	metaDb = pdb + "meta:"
+	defaultTenant = newTenant("", "primitive:")
+	tenants[""] = defaultTenant
 }
 
 // Make a new instance of Primitive, using the bytes read from the reader
@@ -98,77 +131,308 @@ func (p *Primitive) Make(reader *bufio.Reader) error {
 	defer timeTrack(time.Now(), "primtive.Make")
 	// Create a new uuid for this primitive
 	var id = uuid.NewV4().String()
-	var numBytes, chunks int
-	if p.Length == 0 {
+	if p.Length <= 0 {
 		return MISSING_ARG
 	}
+	if err := p.prepare(id); err != nil {
+		return err
+	}
+	options := p.ns().opts()
 	e := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
-		buf := make([]byte, CHUNK_SIZE)
-		for {
-
-			// call read on readWriter until buffer is filled, or EOF
-			var readOffset int
-			for {
-				// get the first chunk of bytes, increment bytes read
-				n1, err := reader.Read(buf[readOffset:])
-				readOffset += n1
-				//fmt.Printf("Primtive.Make: read:%d offset%d error:%q\n", n1, readOffset, err)
-				if err == EOF || readOffset+n1 == CHUNK_SIZE {
-					//fmt.Printf("Primtive.Make: filled buffer:%d byteserror:%q\n", readOffset, err)
-					break
-				} else if numBytes+readOffset >= p.Length {
-					break
-				} else if err != nil && err != EOF {
-					//fmt.Printf("\nPrimitive.Make err not nil or EOF:%q", err)
-					return err
-				}
+		// a retried transaction starts over with no chunks
+		p.Chunks = 0
+		p.Refs, p.Sizes, p.Stripes = nil, nil, nil
+		p.Data, p.Pack = nil, ""
+		digest := newDigest()
+		if p.Length <= options.Inline || p.Length <= options.Pack {
+			buf := make([]byte, p.Length)
+			readOffset, err := io.ReadFull(reader, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return errors.New(fmt.Sprintf("bytes read %d doesn't match expected %d", readOffset, p.Length))
+			} else if err != nil {
+				return err
 			}
-
-			if readOffset > 0 {
-				// process bytes returned from Read before error
-				numBytes = numBytes + readOffset
-				// create key for this chunk
-				ks := []byte(fmt.Sprintf("%s%s:%10d", pdb, id, chunks))
-				key := proto.Key(ks)
-				chunks = chunks + 1
-
-				//fmt.Println("Primitive.Make: check amount read:", key, numBytes, readOffset, p.Length)
-				// check if n1 < CHUNK_SIZE, if so slice off blank end
-				putResp := &proto.PutResponse{}
-				if readOffset < CHUNK_SIZE {
-					//fmt.Println("Primitive.Make: readOffset < than chunk size:", numBytes, readOffset, chunks)
-					sbuf := buf[:readOffset]
-					if err := kvClient.Call(proto.Put, proto.PutArgs(key, sbuf), putResp); err != nil {
-						return err
-					}
-					break
-				} else {
-					if err := kvClient.Call(proto.Put, proto.PutArgs(key, buf), putResp); err != nil {
-						return err
-					}
-				}
-
-			} else if readOffset == 0 {
-				//fmt.Printf("\nPrimitive.Make n1 -s zero, so break")
-				break
+			digest.Write(buf)
+			if p.Length <= options.Inline {
+				err = p.putInline(buf)
+			} else {
+				err = p.putPacked(txn, buf)
+			}
+			if err != nil {
+				return err
 			}
+		} else if err := p.putChunks(txn, reader, p.Length, digest); err != nil {
+			return err
 		}
-		//fmt.Println("Primitive.Make FINISHED READING BYTES:", numBytes, " expected:", p.Length)
-		// check to see if bytes read equals number expected, stored in the original p.Size
-		if p.Length != numBytes {
-			//fmt.Printf("\nPrimitive.Make p.Length:%d not equal to numBytes:%d\n", p.Length, numBytes)
-			return errors.New(fmt.Sprintf("bytes read %d doesn't match expected %d", numBytes, p.Length))
+		if err := p.setDigest(digest); err != nil {
+			return err
 		}
-		p.Id = id
-		p.Chunks = chunks
-		p.CSize = CHUNK_SIZE
-		//fmt.Printf("\nPrimitive.Make assigning length: %d id: %s\n", numBytes, id)
-		//fmt.Printf("\nPrimitive.Make length and id assigned\n")
-		p.SetMeta()
-		return nil
+		// a primitive identical to one already stored becomes a clone
+		// of it, and the chunks just written are dropped
+		if options.DedupFiles {
+			existing, err := p.ns().findDigest(txn, p.Sha256, p.Length)
+			if err == nil {
+				return p.becomeClone(txn, existing)
+			} else if err != NOT_FOUND {
+				return err
+			}
+		}
+		return p.putMeta(txn)
 	})
 
-	return e
+	return p.audit(AUDIT_MAKE, p.Length, e)
+}
+
+// prepare sets p up as a new, empty primitive with the given id, to be
+// stored according to the current options of its tenant
+func (p *Primitive) prepare(id string) error {
+	t, err := LookupTenant(p.Tenant)
+	if err != nil {
+		return err
+	}
+	options := t.opts()
+	p.Id = id
+	p.Chunks = 0
+	p.CSize = CHUNK_SIZE
+	if options.ChunkSize > 0 {
+		p.CSize = options.ChunkSize
+	}
+	p.Refs = nil
+	p.Sizes = nil
+	p.Gen = 0
+	p.Codec = options.Compression
+	p.Dedup = options.Dedup
+	p.Chunking = nil
+	p.Erasure, p.Stripes = nil, nil
+	p.Tier = t.tierFor(p.Length)
+	if p.Owner == "" {
+		p.Owner = p.Actor
+	}
+	if p.Created == "" {
+		p.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+	if err := p.normalizeExpiry(); err != nil {
+		return err
+	}
+	if err := p.normalizeRetain(); err != nil {
+		return err
+	}
+	if options.Erasure != nil {
+		erasure := *options.Erasure
+		p.Erasure = &erasure
+	}
+	if options.Chunking != nil {
+		chunking := *options.Chunking
+		p.Chunking = &chunking
+		p.CSize = chunking.Max
+	}
+	return p.newDataKey()
+}
+
+// putChunks reads exactly length bytes from the reader and writes them as
+// new chunks of p.CSize bytes, or content defined chunks if p has
+// Chunking, after the last chunk of the primitive. Every byte written is
+// also fed to the digest. p.Chunks is advanced for each chunk written, the
+// last of which may be partial.
+func (p *Primitive) putChunks(txn *client.KV, reader *bufio.Reader, length int, digest io.Writer) error {
+	var numBytes, fill int
+	buf := make([]byte, p.CSize)
+	for numBytes < length || fill > 0 {
+		n := p.CSize - fill
+		if length-numBytes < n {
+			n = length - numBytes
+		}
+		// call read on reader until buffer is filled, or EOF
+		readOffset, err := io.ReadFull(reader, buf[fill:fill+n])
+		numBytes = numBytes + readOffset
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New(fmt.Sprintf("bytes read %d doesn't match expected %d", numBytes, length))
+		} else if err != nil {
+			return err
+		}
+		fill = fill + n
+		// bytes past a content defined boundary are kept for the next chunk
+		n = fill
+		if p.Chunking != nil {
+			n = p.Chunking.cut(buf[:fill])
+		}
+		// once a primitive has been rewritten its chunks are listed in
+		// Refs, and new chunks are named for the current generation
+		ref := chunkRef(p.Id, p.Chunks)
+		if p.Refs != nil {
+			ref = p.genRef(p.Chunks)
+		}
+		ref, err = p.putChunk(txn, ref, buf[:n])
+		if err != nil {
+			return err
+		}
+		// deduplicated and tiered chunks are always listed, as they are
+		// named for their content or with a nonce
+		if p.Refs != nil || p.Dedup || p.Tier != "" {
+			p.Refs = append(p.Refs, ref)
+		}
+		if p.Sizes != nil || p.Chunking != nil {
+			p.Sizes = append(p.Sizes, n)
+		}
+		digest.Write(buf[:n])
+		p.Chunks = p.Chunks + 1
+		fill = copy(buf, buf[n:fill])
+	}
+	return nil
+}
+
+// setDigest records the md5 and sha256 of everything written so far, along
+// with the running state of the hashes so a later Append can pick up where
+// it left off
+func (p *Primitive) setDigest(digest *fileDigest) error {
+	state, err := digest.md5.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	shaState, err := digest.sha256.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.Md5 = hex.EncodeToString(digest.md5.Sum(nil))
+	p.Sha256 = hex.EncodeToString(digest.sha256.Sum(nil))
+	p.Digest = state
+	p.ShaState = shaState
+	return nil
+}
+
+// chunkRef returns the key, less the primitive prefix, of chunk number n
+// of the primitive with the given id
+func chunkRef(id string, n int) string {
+	return fmt.Sprintf("%s:%10d", id, n)
+}
+
+// ref returns the key, less the primitive prefix, of chunk number n of p,
+// taking into account any chunks that have been replaced by a copy-on-write
+// or are shared with another primitive
+func (p *Primitive) ref(n int) string {
+	if p.Refs != nil {
+		return p.Refs[n]
+	}
+	return chunkRef(p.Id, n)
+}
+
+// key returns the key of chunk number n of p
+func (p *Primitive) key(n int) proto.Key {
+	return proto.Key(p.ns().pdb + p.ref(n))
+}
+
+// size returns the number of bytes in chunk number n of p
+func (p *Primitive) size(n int) int {
+	if p.Sizes != nil {
+		return p.Sizes[n]
+	}
+	if n == p.Chunks-1 {
+		return p.Length - n*p.CSize
+	}
+	return p.CSize
+}
+
+// offsets returns the byte offset at which each chunk of p starts,
+// followed by p.Length
+func (p *Primitive) offsets() []int {
+	offsets := make([]int, p.Chunks+1)
+	for i := 0; i < p.Chunks; i++ {
+		offsets[i+1] = offsets[i] + p.size(i)
+	}
+	return offsets
+}
+
+// locate returns the number of the chunk holding byte pos of p, and the
+// offset at which that chunk starts. offsets is only needed, and may be
+// nil, when chunks are of varying size.
+func (p *Primitive) locate(pos int, offsets []int) (int, int) {
+	if p.Sizes == nil {
+		n := pos / p.CSize
+		return n, n * p.CSize
+	}
+	n := sort.SearchInts(offsets, pos+1) - 1
+	return n, offsets[n]
+}
+
+// getChunk reads chunk number n of p using kv, decrypting and
+// decompressing it, and rebuilding it from the rest of its stripe if it is
+// erasure coded and lost. A chunk that does not exist is reported as
+// errChunkMissing.
+func (p *Primitive) getChunk(kv *client.KV, n int) ([]byte, error) {
+	if p.Data != nil {
+		return p.decode(inlineRef, p.Data)
+	}
+	if p.Pack != "" {
+		return p.getPacked(kv)
+	}
+	buf, err := p.fetch(kv, p.ref(n))
+	if p.Stripes == nil || (err == nil && p.intact(n, buf)) {
+		return buf, err
+	}
+	if rebuilt, rerr := p.rebuild(kv, n); rerr == nil {
+		return rebuilt, nil
+	}
+	if err == nil {
+		err = errors.New(fmt.Sprintf("chunk %s is damaged", p.ref(n)))
+	}
+	return nil, err
+}
+
+// fetch reads and decodes the chunk stored under ref
+func (p *Primitive) fetch(kv *client.KV, ref string) ([]byte, error) {
+	value, err := p.ns().getStored(kv, p.Tier, ref)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, errChunkMissing
+	}
+	return p.decode(ref, value)
+}
+
+// putChunk writes buf as a chunk of p using kv, compressing it with the
+// codec of p and encrypting it with its data key. The chunk is stored
+// under ref, or under its content hash if p is deduplicated, or under ref
+// and a nonce if p is tiered, and the ref it was stored under is returned.
+func (p *Primitive) putChunk(kv *client.KV, ref string, buf []byte) (string, error) {
+	// a retried transaction must not overwrite a chunk in a tier that
+	// another transaction has since committed
+	if p.Tier != "" {
+		ref = ref + ":" + uuid.NewV4().String()[:12]
+	}
+	value, err := p.encode(ref, buf)
+	if err != nil {
+		return "", err
+	}
+	// deduplicated primitives are never encrypted
+	if p.Dedup {
+		return p.ns().putContent(kv, value)
+	}
+	return ref, p.ns().putStored(kv, p.Tier, ref, value)
+}
+
+// encode compresses and encrypts buf for storing under ref
+func (p *Primitive) encode(ref string, buf []byte) ([]byte, error) {
+	value, err := p.compress(buf)
+	if err != nil {
+		return nil, err
+	}
+	return p.seal(ref, value)
+}
+
+// decode decrypts and decompresses a value stored under ref
+func (p *Primitive) decode(ref string, value []byte) ([]byte, error) {
+	buf, err := p.open(ref, value)
+	if err != nil {
+		return nil, err
+	}
+	return p.decompress(buf)
+}
+
+// metaKey returns the key of the meta record of the primitive of t with
+// the given id
+func (t *Tenant) metaKey(id string) proto.Key {
+	return proto.Key(fmt.Sprintf("%s%s", t.metaDb, id))
 }
 
 // Find an instance of Primitive, using the id arg provided in the args map
@@ -185,20 +449,24 @@ func (p *Primitive) Find() error {
 // Read the keys and values one row at a time, writing the value onto the stream
 // Requires retrieving Meta first, to know how many chunks are there and to be
 // able to generate the correct keys
-func (p *Primitive) Stream(writer *bufio.Writer) error {
+func (p *Primitive) Stream(writer *bufio.Writer) (err error) {
 	defer timeTrack(time.Now(), "primtive.Stream")
 	var b int
-	err := p.Meta() // p is now filled out
+	defer func() { err = p.audit(AUDIT_STREAM, b, err) }()
+	err = p.Meta() // p is now filled out
 	if err != nil {
 		return err
 	}
 	for i := 0; i < p.Chunks; i++ {
-		getResp := &proto.GetResponse{}
-		key := proto.Key(fmt.Sprintf("%s%s:%10d", pdb, p.Id, i))
-		if err := kvClient.Call(proto.Get, proto.GetArgs(key), getResp); err != nil {
+		buf, err := p.getChunk(kvClient, i)
+		// a chunk that has gone missing was replaced by a write since
+		// the meta data was read, stop rather than mix the two versions
+		if err == errChunkMissing {
+			return CHANGED
+		} else if err != nil {
 			return err
 		}
-		p, e := writer.Write(getResp.Value.Bytes)
+		p, e := writer.Write(buf)
 		if e != nil {
 			return e
 		}
@@ -210,45 +478,131 @@ func (p *Primitive) Stream(writer *bufio.Writer) error {
 // Destroy the bytes associated with the id arg provided in the args map
 // If the file is found, return id and number of bytes destroyed in reply
 // otherwise return an error "Primitive Not Found"
+// With Options.TrashDays set, the primitive is put in the trash instead
+// A locked primitive is not destroyed, and LOCKED is returned
 func (p *Primitive) Destroy() error {
+	err := p.remove()
+	return p.audit(AUDIT_DESTROY, p.Length, err)
+}
 
-	err := p.Meta() // p is now filled out
-	if err != nil {
+func (p *Primitive) remove() error {
+	if p.ns().opts().TrashDays > 0 {
+		return p.trash()
+	}
+	// the chunks are released in the same transaction as the meta data is
+	// deleted, so a retry never releases a chunk twice
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.getMeta(txn); err != nil { // p is now filled out
+			return err
+		}
+		if err := p.allow(PERM_DELETE); err != nil {
+			return err
+		}
+		// chunks shared with a clone are left for the clone
+		return p.destroy(txn)
+	})
+}
+
+// Meta reads the meta data of the primitive with id p.Id into p, returning
+// FORBIDDEN if p.Actor may not read it
+func (p *Primitive) Meta() error {
+	if err := p.getMeta(kvClient); err != nil {
 		return err
 	}
-	for i := 0; i < p.Chunks; i++ {
-		delReq := &proto.DeleteRequest{}
-		delReq.Key = proto.Key(fmt.Sprintf("%s%s:%10d", pdb, p.Id, i))
-		delResp := &proto.DeleteResponse{}
-		err := kvClient.Call(proto.Delete, delReq, delResp)
-		if err != nil {
+	return p.allow(PERM_READ)
+}
+
+// SetMeta stores the descriptive meta data of p, its name, mime type,
+// expiry, trash time, owner and access control list, unless the stored
+// primitive is locked, when LOCKED is returned. Only the owner may change
+// the owner or access control list, and expiring or trashing it needs
+// delete permission. How the contents are stored is kept as it is stored,
+// so a copy of the meta data read before a write can't undo it. On
+// success p holds the meta data as stored.
+func (p *Primitive) SetMeta() error {
+	return p.audit(AUDIT_SETMETA, 0, kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.normalizeExpiry(); err != nil {
 			return err
 		}
+		stored := Primitive{Id: p.Id, Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+		if err := stored.readMeta(txn); err != nil && err != NOT_FOUND {
+			return err
+		} else if err == nil && stored.locked(time.Now()) {
+			return LOCKED
+		} else if err == nil {
+			if err := p.allowChange(&stored); err != nil {
+				return err
+			}
+		}
+		record := stored
+		record.Name, record.MimeType = p.Name, p.MimeType
+		record.Expires, record.Trashed = p.Expires, p.Trashed
+		record.Owner, record.ACL = p.Owner, p.ACL
+		if err := record.putMeta(txn); err != nil {
+			return err
+		}
+		*p = record
+		return nil
+	}))
+}
+
+// getMeta reads the meta data for p.Id using kv, which may be either the
+// shared client or a transaction. An expired primitive, or one in the
+// trash, is not found.
+func (p *Primitive) getMeta(kv *client.KV) error {
+	if err := p.readMeta(kv); err != nil {
+		return err
+	}
+	if p.hidden(time.Now()) {
+		return NOT_FOUND
 	}
-	return p.DestroyMeta()
+	return nil
 }
 
-func (p *Primitive) Meta() error {
+// readMeta reads the meta data for p.Id, hidden or not
+func (p *Primitive) readMeta(kv *client.KV) error {
 	if p.Id == "" || len(p.Id) != 32 {
 		return errors.New(fmt.Sprintf("Invalid primtive id:%s", p.Id))
 	}
 
-	key := proto.Key(fmt.Sprintf("%s%s", metaDb, p.Id))
+	key := p.ns().metaKey(p.Id)
 	getResp := &proto.GetResponse{}
-	if err := kvClient.Call(proto.Get, proto.GetArgs(key), getResp); err != nil {
+	if err := kv.Call(proto.Get, proto.GetArgs(key), getResp); err != nil {
 		return err
 	}
 	if getResp.Value == nil {
 		return NOT_FOUND
 	}
+	// decode into a fresh primitive, so nothing is left over from an
+	// earlier read of a different version
+	var meta Primitive
 	var dec *codec.Decoder = codec.NewDecoderBytes(getResp.Value.Bytes, mph)
-	return dec.Decode(p)
+	if err := dec.Decode(&meta); err != nil {
+		return err
+	}
+	meta.Actor, meta.Groups, meta.Tenant = p.Actor, p.Groups, p.Tenant
+	*p = meta
+	return nil
 }
 
-func (p *Primitive) SetMeta() error {
+// putMeta writes the meta data for p using kv, which may be either the
+// shared client or a transaction
+func (p *Primitive) putMeta(kv *client.KV) error {
 	if p.Id == "" || len(p.Id) != 32 {
 		return errors.New(fmt.Sprintf("Invalid primtive id:%s", p.Id))
 	}
+	if err := p.protect(kv); err != nil {
+		return err
+	}
+	if err := p.normalizeExpiry(); err != nil {
+		return err
+	}
+	if err := p.normalizeRetain(); err != nil {
+		return err
+	}
+	if err := p.index(kv); err != nil {
+		return err
+	}
 	// 1. encode primitive to an array of bytes
 	var buf []byte
 	var enc *codec.Encoder = codec.NewEncoderBytes(&buf, mph) // mph is the msgpack codec
@@ -258,9 +612,9 @@ func (p *Primitive) SetMeta() error {
 		return err
 	}
 	// 2. set value of key (primitive.Id)
-	key := proto.Key(fmt.Sprintf("%s%s", metaDb, p.Id))
+	key := p.ns().metaKey(p.Id)
 	putResp := &proto.PutResponse{}
-	err = kvClient.Call(proto.Put, proto.PutArgs(key, buf), putResp)
+	err = kv.Call(proto.Put, proto.PutArgs(key, buf), putResp)
 	if err != nil {
 		fmt.Println("SetMeta:", key, buf)
 	}
@@ -268,20 +622,28 @@ func (p *Primitive) SetMeta() error {
 	return err
 }
 
+// DestroyMeta deletes the meta data of p, whether it is hidden or not,
+// releasing its chunks in the same transaction, unless p is locked, when
+// LOCKED is returned, or p.Actor may not delete it, when FORBIDDEN is
+// returned
 func (p *Primitive) DestroyMeta() error {
 	if p.Id == "" || len(p.Id) != 32 {
 		return errors.New(fmt.Sprintf("Invalid primtive id:%s", p.Id))
 	}
-	delReq := &proto.DeleteRequest{}
-	delReq.Key = proto.Key(fmt.Sprintf("%s%s", metaDb, p.Id))
-	delResp := &proto.DeleteResponse{}
-
-	fmt.Println("DestroyMeta:", delReq.Key)
+	fmt.Println("DestroyMeta:", p.ns().metaKey(p.Id))
 
-	err := kvClient.Call(proto.Delete, delReq, delResp)
+	err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.readMeta(txn); err != nil {
+			return err
+		}
+		if err := p.allow(PERM_DELETE); err != nil {
+			return err
+		}
+		return p.destroy(txn)
+	})
+	p.audit(AUDIT_DESTROY, p.Length, err)
 	if err != nil {
 		p.Id = ""
 	}
 	return err
-
 }
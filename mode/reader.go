@@ -0,0 +1,170 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Reader gives random access to the bytes of a primitive. It reads against
+// the version of the primitive that was current when it was opened: if a
+// later write replaces a chunk it still has to fetch, reads fail with
+// CHANGED instead of returning bytes from two different versions. The last
+// chunk fetched is kept, so reading it in small pieces fetches it once.
+type Reader struct {
+	p       Primitive
+	offsets []int
+	offset  int64
+
+	mu     sync.Mutex
+	read   int    // bytes read since the last audit record
+	failed error  // first failed read since the last audit record
+	chunk  int    // number of the chunk in buf
+	buf    []byte // the last chunk read, decoded, nil if none
+}
+
+// Open returns a Reader over the primitive with id p.Id. p is filled out
+// with the meta data the reader was opened against. Opening the reader is
+// audited, and so are the reads with it, in one record of the bytes read
+// each time a read reaches the end, and on Close.
+func (p *Primitive) Open() (*Reader, error) {
+	err := p.audit(AUDIT_OPEN, 0, p.Meta()) // p is now filled out
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{p: *p, offsets: p.offsets()}, nil
+}
+
+// Size returns the length of the primitive as it was when opened
+func (r *Reader) Size() int64 {
+	return int64(r.p.Length)
+}
+
+// ReadAt implements io.ReaderAt
+func (r *Reader) ReadAt(b []byte, off int64) (n int, err error) {
+	defer func() {
+		r.mu.Lock()
+		r.read = r.read + n
+		// reading up to the end is no failure
+		if err != nil && err != io.EOF && r.failed == nil {
+			r.failed = err
+		}
+		r.mu.Unlock()
+		if off+int64(n) >= int64(r.p.Length) {
+			r.record()
+		}
+	}()
+	if off < 0 {
+		return 0, errors.New(fmt.Sprintf("negative offset %d", off))
+	}
+	for n < len(b) && off+int64(n) < int64(r.p.Length) {
+		pos := int(off) + n
+		chunk, start := r.p.locate(pos, r.offsets)
+		buf, err := r.getChunk(chunk)
+		if err == errChunkMissing || (err == nil && len(buf) <= pos-start) {
+			return n, CHANGED
+		} else if err != nil {
+			return n, err
+		}
+		n = n + copy(b[n:], buf[pos-start:])
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// getChunk returns chunk n, keeping the last chunk read so that reads of
+// a chunk in small pieces fetch, decrypt and decompress it once
+func (r *Reader) getChunk(n int) ([]byte, error) {
+	r.mu.Lock()
+	buf := r.buf
+	cached := buf != nil && r.chunk == n
+	r.mu.Unlock()
+	if cached {
+		return buf, nil
+	}
+	buf, err := r.p.getChunk(kvClient, n)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.chunk, r.buf = n, buf
+	r.mu.Unlock()
+	return buf, nil
+}
+
+// Close implements io.Closer, recording the reads not yet audited
+func (r *Reader) Close() error {
+	r.record()
+	return nil
+}
+
+// record writes an audit record of the reads since the last one, if any
+func (r *Reader) record() {
+	r.mu.Lock()
+	read, failed := r.read, r.failed
+	r.read, r.failed = 0, nil
+	r.mu.Unlock()
+	if read > 0 || failed != nil {
+		r.p.audit(AUDIT_READ, read, failed)
+	}
+}
+
+// Read implements io.Reader
+func (r *Reader) Read(b []byte) (int, error) {
+	if r.offset >= int64(r.p.Length) {
+		return 0, io.EOF
+	}
+	n, err := r.ReadAt(b, r.offset)
+	r.offset = r.offset + int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset = offset + r.offset
+	case 2:
+		offset = offset + int64(r.p.Length)
+	default:
+		return r.offset, errors.New(fmt.Sprintf("invalid whence %d", whence))
+	}
+	if offset < 0 {
+		return r.offset, errors.New(fmt.Sprintf("negative offset %d", offset))
+	}
+	r.offset = offset
+	return offset, nil
+}
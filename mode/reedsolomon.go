@@ -0,0 +1,226 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+)
+
+// Reed-Solomon erasure coding over GF(2^8), with the field generated by
+// x^8 + x^4 + x^3 + x^2 + 1. The coding matrix is a Vandermonde matrix
+// made systematic, so the first rows pass the data shards through
+// unchanged and any data rows of it are invertible, which is what lets any
+// data shards out of data+parity rebuild the rest.
+
+var gfExp [512]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x = x << 1
+		if x&0x100 != 0 {
+			x = x ^ 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// gfMatrix is a matrix of field elements, by row
+type gfMatrix [][]byte
+
+func newMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for r := range m {
+		m[r] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) mul(o gfMatrix) gfMatrix {
+	out := newMatrix(len(m), len(o[0]))
+	for r := range m {
+		for c := range o[0] {
+			var v byte
+			for i := range o {
+				v = v ^ gfMul(m[r][i], o[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of the square matrix m, by Gauss-Jordan
+// elimination
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot = pivot + 1
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				f := work[r][c]
+				for i := range work[r] {
+					work[r][i] = work[r][i] ^ gfMul(f, work[c][i])
+				}
+			}
+		}
+	}
+	inv := newMatrix(n, n)
+	for r := range inv {
+		copy(inv[r], work[r][n:])
+	}
+	return inv, nil
+}
+
+// reedSolomon codes data shards into parity shards. Every shard of a
+// stripe must be the same length.
+type reedSolomon struct {
+	data, parity int
+	matrix       gfMatrix // data+parity rows by data columns
+}
+
+func newReedSolomon(data, parity int) (*reedSolomon, error) {
+	if data < 1 || parity < 1 || data+parity > 256 {
+		return nil, errors.New("erasure coding needs at least one data and one parity shard, and at most 256 in all")
+	}
+	vandermonde := newMatrix(data+parity, data)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := vandermonde[:data].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{data: data, parity: parity, matrix: vandermonde.mul(top)}, nil
+}
+
+// encode computes the parity shards, shards[data:], from the data shards
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for r := rs.data; r < rs.data+rs.parity; r++ {
+		rs.apply(rs.matrix[r], shards[:rs.data], shards[r])
+	}
+}
+
+// reconstruct fills in the shards that are nil from those that are not, of
+// which there must be at least data
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	var present []int
+	size := 0
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.data {
+			present = append(present, i)
+			size = len(shard)
+		}
+	}
+	if len(present) < rs.data {
+		return errors.New("too many shards lost to reconstruct")
+	}
+	sub := make(gfMatrix, rs.data)
+	in := make([][]byte, rs.data)
+	for i, s := range present {
+		sub[i] = rs.matrix[s]
+		in[i] = shards[s]
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < rs.data; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			rs.apply(decode[i], in, shards[i])
+		}
+	}
+	for r := rs.data; r < rs.data+rs.parity; r++ {
+		if shards[r] == nil {
+			shards[r] = make([]byte, size)
+			rs.apply(rs.matrix[r], shards[:rs.data], shards[r])
+		}
+	}
+	return nil
+}
+
+// apply sets out to the sum of the shards in, each multiplied by its
+// coefficient in row
+func (rs *reedSolomon) apply(row []byte, in [][]byte, out []byte) {
+	for j := range out {
+		out[j] = 0
+	}
+	for i, shard := range in {
+		f := row[i]
+		if f == 0 {
+			continue
+		}
+		for j, b := range shard {
+			out[j] = out[j] ^ gfMul(f, b)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"time"
+)
+
+// A primitive with a retention time, or under a legal hold, is locked: it
+// can't be written, appended to, truncated, have its meta data set, be put
+// in the trash or be destroyed, and it doesn't expire. Such attempts fail
+// with LOCKED. A retention time can be extended but not brought forward,
+// and anyone may place a hold, but only a call bearing the custodian secret
+// releases a lock early. Only a hash of the secret is stored, and until one
+// is set no lock can be released. Moving chunks between tiers,
+// recompressing them, rotating keys and repairs still go ahead, as they
+// leave the contents as they were.
+
+// locked reports whether p is under a retention time or a legal hold
+func (p *Primitive) locked(now time.Time) bool {
+	if p.Hold {
+		return true
+	}
+	if p.Retain == "" {
+		return false
+	}
+	retain, err := time.Parse(time.RFC3339, p.Retain)
+	// a retention time that can't be read keeps the primitive locked
+	return err != nil || now.Before(retain)
+}
+
+// normalizeRetain checks Retain and puts it in UTC
+func (p *Primitive) normalizeRetain() error {
+	if p.Retain == "" {
+		return nil
+	}
+	retain, err := time.Parse(time.RFC3339, p.Retain)
+	if err != nil {
+		return err
+	}
+	p.Retain = retain.UTC().Format(time.RFC3339)
+	return nil
+}
+
+// Lock keeps the primitive with id p.Id as it is until the given time. A
+// retention time already later than until is kept.
+func (p *Primitive) Lock(until time.Time) error {
+	defer timeTrack(time.Now(), "primitive.Lock")
+	return p.audit(AUDIT_LOCK, 0, kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.getMeta(txn); err != nil {
+			return err
+		}
+		if err := p.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if p.Retain != "" {
+			retain, err := time.Parse(time.RFC3339, p.Retain)
+			if err != nil || !until.After(retain) {
+				return nil
+			}
+		}
+		p.Retain = until.UTC().Format(time.RFC3339)
+		return p.putMeta(txn)
+	}))
+}
+
+// PlaceHold puts the primitive with id p.Id under a legal hold, which
+// keeps it as it is until a custodian releases it
+func (p *Primitive) PlaceHold() error {
+	defer timeTrack(time.Now(), "primitive.PlaceHold")
+	return p.audit(AUDIT_HOLD, 0, kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.getMeta(txn); err != nil {
+			return err
+		}
+		if err := p.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if p.Hold {
+			return nil
+		}
+		p.Hold = true
+		return p.putMeta(txn)
+	}))
+}
+
+// Release lifts the legal hold and the retention time of the primitive
+// with id p.Id. The custodian secret must be the one set, or FORBIDDEN is
+// returned.
+func (p *Primitive) Release(custodian string) error {
+	defer timeTrack(time.Now(), "primitive.Release")
+	return p.audit(AUDIT_RELEASE, 0, kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.ns().checkCustodian(txn, custodian); err == NOT_FOUND {
+			return FORBIDDEN
+		} else if err != nil {
+			return err
+		}
+		if err := p.readMeta(txn); err != nil {
+			return err
+		}
+		p.Hold, p.Retain = false, ""
+		return p.putMeta(txn)
+	}))
+}
+
+// SetCustodian sets the custodian secret of the default tenant
+func SetCustodian(current, next string) error {
+	return defaultTenant.SetCustodian(current, next)
+}
+
+// SetCustodian sets the custodian secret of t to next. Once a secret is
+// set, current must be it, or FORBIDDEN is returned.
+func (t *Tenant) SetCustodian(current, next string) error {
+	defer timeTrack(time.Now(), "SetCustodian")
+	if next == "" {
+		return MISSING_ARG
+	}
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := t.checkCustodian(txn, current); err != nil && err != NOT_FOUND {
+			return err
+		}
+		sum := sha256.Sum256([]byte(next))
+		return putRecord(txn, t.custodianKey(), sum[:])
+	})
+}
+
+// checkCustodian returns FORBIDDEN unless custodian is the secret set for
+// t, or NOT_FOUND if none is
+func (t *Tenant) checkCustodian(kv *client.KV, custodian string) error {
+	var stored []byte
+	if err := getRecord(kv, t.custodianKey(), &stored); err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(custodian))
+	if subtle.ConstantTimeCompare(sum[:], stored) != 1 {
+		return FORBIDDEN
+	}
+	return nil
+}
+
+func (t *Tenant) custodianKey() proto.Key {
+	return proto.Key(t.pdb + "custodian")
+}
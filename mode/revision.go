@@ -0,0 +1,177 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/twinj/uuid"
+	"github.com/ugorji/go/codec"
+	"time"
+)
+
+// With Options.Revisions set, a write, truncate or append keeps the
+// contents it replaces as a revision of the primitive. A revision is a
+// clone kept in the revision subspace rather than listed, sharing its
+// chunks with the primitive, so only the chunks written since cost
+// anything. Revisions are keyed by primitive and the time they were
+// replaced, and go when the primitive is destroyed, or when they are
+// pruned, by PruneRevisions or a lifecycle rule. Appends to sessions and
+// multipart uploads keep none, as the primitive isn't made until they end.
+
+// Revision is the contents of a primitive as they were until the time in
+// Seq, which is followed by a nonce as the time alone may not be unique
+type Revision struct {
+	Seq       string    `json:"seq"`
+	Primitive Primitive `json:"primitive"`
+}
+
+// revisionKey is the key of the revision of the primitive with id id
+func (t *Tenant) revisionKey(id, seq string) proto.Key {
+	return proto.Key(t.revisionDb + id + ":" + seq)
+}
+
+// keepRevision keeps the contents of p as a revision, if Options.Revisions
+// is set, before they are changed in the same transaction. Inline and
+// packed contents must already have been spilled.
+func (p *Primitive) keepRevision(txn *client.KV) error {
+	if !p.ns().opts().Revisions {
+		return nil
+	}
+	r := &Revision{Seq: time.Now().UTC().Format(auditTime) + "|" + uuid.NewV4().String()[:12]}
+	r.Primitive = Primitive{Id: p.Id, Name: p.Name, MimeType: p.MimeType, Created: p.Created,
+		Owner: p.Owner, Tenant: p.Tenant}
+	if err := r.Primitive.cloneOf(txn, p); err != nil {
+		return err
+	}
+	if err := putRecord(txn, p.ns().revisionKey(p.Id, r.Seq), r); err != nil {
+		return err
+	}
+	p.Revs = p.Revs + 1
+	return nil
+}
+
+// Revisions returns the revisions kept of the primitive with id p.Id,
+// oldest first
+func (p *Primitive) Revisions() ([]Revision, error) {
+	defer timeTrack(time.Now(), "primitive.Revisions")
+	if err := p.Meta(); err != nil {
+		return nil, err
+	}
+	return p.readRevisions(kvClient)
+}
+
+// readRevisions returns every revision of p, oldest first
+func (p *Primitive) readRevisions(kv *client.KV) ([]Revision, error) {
+	var revisions []Revision
+	start := p.ns().revisionKey(p.Id, "")
+	end := start.PrefixEnd()
+	for {
+		rows, err := scan(kv, start, end, 100)
+		if err != nil {
+			return revisions, err
+		}
+		for _, row := range rows {
+			var r Revision
+			var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+			if err := dec.Decode(&r); err != nil {
+				return revisions, err
+			}
+			// reads of the revision are done for the actor too
+			r.Primitive.Actor, r.Primitive.Groups, r.Primitive.Tenant = p.Actor, p.Groups, p.Tenant
+			revisions = append(revisions, r)
+		}
+		if len(rows) < 100 {
+			return revisions, nil
+		}
+		start = rows[len(rows)-1].Key.Next()
+	}
+}
+
+// Open returns a Reader over the contents of the revision
+func (r *Revision) Open() (*Reader, error) {
+	return &Reader{p: r.Primitive, offsets: r.Primitive.offsets()}, nil
+}
+
+// PruneRevisions destroys all but the newest keep revisions of the
+// primitive with id p.Id, returning the number destroyed. The revisions
+// of a locked primitive are kept, and LOCKED is returned.
+func (p *Primitive) PruneRevisions(keep int) (int, error) {
+	defer timeTrack(time.Now(), "primitive.PruneRevisions")
+	var pruned int
+	err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		pruned = 0
+		if err := p.getMeta(txn); err != nil { // p is now filled out
+			return err
+		}
+		if err := p.allow(PERM_DELETE); err != nil {
+			return err
+		}
+		if p.locked(time.Now()) {
+			return LOCKED
+		}
+		revisions, err := p.readRevisions(txn)
+		if err != nil {
+			return err
+		}
+		for len(revisions) > keep {
+			if err := p.dropRevision(txn, &revisions[0]); err != nil {
+				return err
+			}
+			revisions = revisions[1:]
+			pruned = pruned + 1
+		}
+		p.Revs = len(revisions)
+		return p.putMeta(txn)
+	})
+	return pruned, p.audit(AUDIT_PRUNE, 0, err)
+}
+
+// dropRevisions destroys every revision of p, as p is destroyed. The
+// revisions are found by scanning for them rather than by trusting Revs.
+func (p *Primitive) dropRevisions(txn *client.KV) error {
+	revisions, err := p.readRevisions(txn)
+	if err != nil {
+		return err
+	}
+	for i := range revisions {
+		if err := p.dropRevision(txn, &revisions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropRevision releases the chunks of the revision r of p and deletes it
+func (p *Primitive) dropRevision(txn *client.KV, r *Revision) error {
+	if err := r.Primitive.releaseChunks(txn); err != nil {
+		return err
+	}
+	delReq := &proto.DeleteRequest{}
+	delReq.Key = p.ns().revisionKey(p.Id, r.Seq)
+	return txn.Call(proto.Delete, delReq, &proto.DeleteResponse{})
+}
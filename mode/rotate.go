@@ -0,0 +1,246 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"strings"
+	"time"
+)
+
+// RotateJob is the progress of a master key rotation. It is checkpointed in
+// the datamode.Primitive.Job subspace in the same transaction as each
+// record it rotates, so a rotation that is interrupted resumes where it
+// stopped and rotates nothing twice.
+type RotateJob struct {
+	KeyId       string `json:"keyId"`       // the master key data keys are being wrapped with
+	Full        bool   `json:"full"`        // whether chunks are re-encrypted under new data keys as well
+	After       string `json:"after"`       // key of the last record rotated
+	Rewrapped   int    `json:"rewrapped"`   // data keys wrapped again with the master key
+	Reencrypted int    `json:"reencrypted"` // primitives whose chunks were rewritten under a new data key
+}
+
+// RotateKeys wraps the data key of every encrypted primitive, revision,
+// upload session and multipart upload of the default tenant with the
+// current master key of the key provider, leaving the chunks as they are.
+// With full set, the chunks of each primitive are also rewritten under a
+// new data key, copy-on-write, so readers see either the old or the new
+// version. Revisions, and sessions and uploads still in progress, are only
+// re-wrapped. A master key may be retired once a rotation away from it has
+// completed.
+//
+// A rotation checkpoints as it goes, and calling RotateKeys again with the
+// same master key and mode resumes it. Records already wrapped with the
+// current master key are skipped, unless full is set.
+func RotateKeys(full bool) (*RotateJob, error) {
+	return defaultTenant.RotateKeys(full)
+}
+
+// RotateKeys rotates the keys of the records of t, with the key provider of
+// its options
+func (t *Tenant) RotateKeys(full bool) (*RotateJob, error) {
+	defer timeTrack(time.Now(), "RotateKeys")
+	keys := t.opts().Keys
+	if keys == nil {
+		return nil, errors.New("no key provider is set")
+	}
+	// the provider names its current master key when it wraps with it
+	keyId, _, err := keys.Wrap(make([]byte, 32))
+	if err != nil {
+		return nil, err
+	}
+	job := &RotateJob{}
+	err = getRecord(kvClient, t.rotateKey(), job)
+	if err == NOT_FOUND || (err == nil && (job.KeyId != keyId || job.Full != full)) {
+		job = &RotateJob{KeyId: keyId, Full: full}
+	} else if err != nil {
+		return nil, err
+	}
+	// the subspaces holding data keys, in key order
+	for _, prefix := range []string{t.metaDb, t.multipartDb, t.revisionDb, t.sessionDb} {
+		start := proto.Key(prefix)
+		end := start.PrefixEnd()
+		if job.After >= string(end) {
+			continue
+		}
+		if job.After >= prefix {
+			start = proto.Key(job.After).Next()
+		}
+		for {
+			rows, err := scan(kvClient, start, end, 100)
+			if err != nil {
+				return job, err
+			}
+			for _, row := range rows {
+				id := strings.TrimPrefix(string(row.Key), prefix)
+				// parts of multipart uploads are stored under the upload
+				if prefix == t.multipartDb && strings.Contains(id, ":") {
+					continue
+				}
+				if err := job.rotate(t, prefix, id); err != nil {
+					return job, err
+				}
+			}
+			if len(rows) < 100 {
+				break
+			}
+			start = rows[len(rows)-1].Key.Next()
+		}
+	}
+	delReq := &proto.DeleteRequest{}
+	delReq.Key = t.rotateKey()
+	return job, kvClient.Call(proto.Delete, delReq, &proto.DeleteResponse{})
+}
+
+// rotate rotates the record with the given id in the subspace prefix of t,
+// and checkpoints the job past it
+func (job *RotateJob) rotate(t *Tenant, prefix, id string) error {
+	var done RotateJob
+	err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		var err error
+		done = *job
+		switch prefix {
+		case t.metaDb:
+			err = done.rotatePrimitive(txn, t, id)
+		case t.multipartDb:
+			err = done.rotateMultipart(txn, t, id)
+		case t.revisionDb:
+			err = done.rotateRevision(txn, t, id)
+		case t.sessionDb:
+			err = done.rotateSession(txn, t, id)
+		}
+		if err != nil {
+			return err
+		}
+		done.After = prefix + id
+		return putRecord(txn, t.rotateKey(), &done)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("rotating %s%s: %s", prefix, id, err))
+	}
+	*job = done
+	return nil
+}
+
+// rotatePrimitive rotates the key of a primitive, including one in the
+// trash, which must stay readable until it is purged
+func (job *RotateJob) rotatePrimitive(txn *client.KV, t *Tenant, id string) error {
+	p := &Primitive{Id: id, Tenant: t.Name}
+	if err := p.readMeta(txn); err == NOT_FOUND {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if job.Full && p.Cipher == CIPHER {
+		if err := p.reencrypt(txn); err != nil {
+			return err
+		}
+		job.Reencrypted = job.Reencrypted + 1
+		return p.putMeta(txn)
+	}
+	if ok, err := p.rewrap(job.KeyId); err != nil || !ok {
+		return err
+	}
+	job.Rewrapped = job.Rewrapped + 1
+	return p.putMeta(txn)
+}
+
+func (job *RotateJob) rotateMultipart(txn *client.KV, t *Tenant, id string) error {
+	m := &Multipart{Id: id, Tenant: t.Name}
+	if err := m.get(txn); err == UPLOAD_NOT_FOUND {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if ok, err := m.Primitive.rewrap(job.KeyId); err != nil || !ok {
+		return err
+	}
+	job.Rewrapped = job.Rewrapped + 1
+	return putRecord(txn, m.key(), m)
+}
+
+// rotateRevision rewraps the key of a revision, whose chunks are shared
+// and so are never reencrypted
+func (job *RotateJob) rotateRevision(txn *client.KV, t *Tenant, id string) error {
+	r := &Revision{}
+	if err := getRecord(txn, proto.Key(t.revisionDb+id), r); err == NOT_FOUND {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r.Primitive.Tenant = t.Name
+	if ok, err := r.Primitive.rewrap(job.KeyId); err != nil || !ok {
+		return err
+	}
+	job.Rewrapped = job.Rewrapped + 1
+	return putRecord(txn, proto.Key(t.revisionDb+id), r)
+}
+
+func (job *RotateJob) rotateSession(txn *client.KV, t *Tenant, id string) error {
+	s := &Session{Id: id, Tenant: t.Name}
+	if err := s.get(txn); err == SESSION_NOT_FOUND {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if ok, err := s.Primitive.rewrap(job.KeyId); err != nil || !ok {
+		return err
+	}
+	job.Rewrapped = job.Rewrapped + 1
+	// stored as is, since rotating a session doesn't renew its expiry
+	return putRecord(txn, s.key(), s)
+}
+
+// rewrap wraps the data key of p with the current master key, reporting
+// whether p needed it. The data key itself, and so the chunks, stay the same.
+func (p *Primitive) rewrap(keyId string) (bool, error) {
+	if p.Cipher == "" || p.KeyId == keyId {
+		return false, nil
+	}
+	key, err := p.unwrapKey()
+	if err != nil {
+		return false, err
+	}
+	p.KeyId, p.DataKey, err = p.ns().opts().Keys.Wrap(key)
+	return err == nil, err
+}
+
+// reencrypt rewrites every chunk of p under a new data key. Chunks shared
+// with a clone are released to the clone, which keeps the old data key.
+func (p *Primitive) reencrypt(txn *client.KV) error {
+	if _, err := p.dataKey(); err != nil {
+		return err
+	}
+	return p.rewrite(txn, p.newDataKey)
+}
+
+func (t *Tenant) rotateKey() proto.Key {
+	return proto.Key(t.jobDb + "rotate")
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/twinj/uuid"
+	"github.com/ugorji/go/codec"
+	"time"
+)
+
+// How long an upload session may sit idle before it is collected
+var SESSION_TTL = 24 * time.Hour
+
+// Session is an upload in progress. Bytes are written to it in order, in
+// as many calls as it takes and from as many processes as need be, and
+// once all have arrived it is finalized into a Primitive. The chunks are
+// written under the id the primitive will have, so finalizing moves no
+// data. Sessions are stored in the datamode.Primitive.Session subspace.
+//
+// A session is checked against the owner and access control list of its
+// primitive, as the primitive itself would be: finding it, writing to it
+// or finalizing it needs write permission, aborting it delete permission.
+type Session struct {
+	Id        string    `json:"id"`               // UUID of the session, and of the primitive it becomes
+	Length    int       `json:"length,omitempty"` // number of bytes expected, if known at the start
+	Expires   int64     `json:"expires"`          // unix time after which the idle session is collected
+	Primitive Primitive `json:"primitive"`        // the primitive so far, its Length is the bytes committed
+
+	Actor  string   `json:"-" codec:"-"` // who operations on the session are done for, not stored
+	Groups []string `json:"-" codec:"-"` // groups the actor is a member of, not stored
+	Tenant string   `json:"-" codec:"-"` // name of the tenant the session belongs to, not stored
+}
+
+// StartSession begins an upload session for a new primitive. Name,
+// MimeType, Expires, Owner and ACL are taken from p, the owner defaulting
+// to p.Actor, as is Length, which if set is the number of bytes Finalize
+// will expect.
+func (p *Primitive) StartSession() (*Session, error) {
+	var id = uuid.NewV4().String()
+	s := &Session{Id: id, Length: p.Length, Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+	s.Primitive = Primitive{Name: p.Name, MimeType: p.MimeType, Expires: p.Expires, Owner: p.Owner, ACL: p.ACL,
+		Actor: p.Actor, Groups: p.Groups, Tenant: p.Tenant}
+	if err := s.Primitive.prepare(id); err != nil {
+		return nil, err
+	}
+	// the primitive has no length of its own until bytes are committed
+	s.Primitive.Tier = s.Primitive.ns().tierFor(s.Length)
+	if err := s.put(kvClient); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Find reloads the session with id s.Id, returning SESSION_NOT_FOUND if it
+// has been finalized, aborted or collected
+func (s *Session) Find() error {
+	if err := s.get(kvClient); err != nil {
+		return err
+	}
+	return s.Primitive.allow(PERM_WRITE)
+}
+
+// Offset returns the number of bytes committed to the session, which is
+// where the next Write must start
+func (s *Session) Offset() int {
+	return s.Primitive.Length
+}
+
+// Write commits length bytes from the reader to the session. offset is
+// where the caller believes the bytes belong and must equal the number of
+// bytes already committed, otherwise WRONG_OFFSET is returned and nothing
+// is written; a client that lost track after a dropped connection should
+// Find the session and resume from Offset. Each write renews the session.
+func (s *Session) Write(reader *bufio.Reader, offset, length int) error {
+	defer timeTrack(time.Now(), "session.Write")
+	if length <= 0 {
+		return MISSING_ARG
+	}
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := s.get(txn); err != nil {
+			return err
+		}
+		if err := s.Primitive.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if offset != s.Offset() {
+			return WRONG_OFFSET
+		}
+		if s.Length > 0 && offset+length > s.Length {
+			return errors.New(fmt.Sprintf("write of %d bytes at %d overruns expected length %d", length, offset, s.Length))
+		}
+		if err := s.Primitive.appendFrom(txn, reader, length); err != nil {
+			return err
+		}
+		return s.put(txn)
+	})
+}
+
+// Finalize turns the session into a Primitive, which is returned. The
+// session no longer exists afterwards.
+func (s *Session) Finalize() (*Primitive, error) {
+	defer timeTrack(time.Now(), "session.Finalize")
+	p := new(Primitive)
+	e := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := s.get(txn); err != nil {
+			return err
+		}
+		if err := s.Primitive.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if s.Offset() == 0 {
+			return MISSING_ARG
+		}
+		if s.Length > 0 && s.Offset() != s.Length {
+			return errors.New(fmt.Sprintf("bytes committed %d doesn't match expected %d", s.Offset(), s.Length))
+		}
+		*p = s.Primitive
+		if err := p.putMeta(txn); err != nil {
+			return err
+		}
+		return s.del(txn)
+	})
+	if e != nil {
+		return nil, (&Primitive{Id: s.Id, Actor: s.Actor, Tenant: s.Tenant}).audit(AUDIT_MAKE, 0, e)
+	}
+	return p, p.audit(AUDIT_MAKE, p.Length, nil)
+}
+
+// Abort discards the session and every byte committed to it
+func (s *Session) Abort() error {
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := s.get(txn); err != nil {
+			return err
+		}
+		if err := s.Primitive.allow(PERM_DELETE); err != nil {
+			return err
+		}
+		return s.abort(txn)
+	})
+}
+
+// CollectSessions aborts every session of the default tenant that has been
+// idle for longer than SESSION_TTL, returning the number collected
+func CollectSessions() (int, error) {
+	return defaultTenant.CollectSessions()
+}
+
+// CollectSessions aborts every session of t that has been idle for longer
+// than SESSION_TTL, returning the number collected. It is meant to be run
+// periodically.
+func (t *Tenant) CollectSessions() (int, error) {
+	defer timeTrack(time.Now(), "CollectSessions")
+	var collected int
+	start := proto.Key(t.sessionDb)
+	end := start.PrefixEnd()
+	now := time.Now().Unix()
+	for {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return collected, err
+		}
+		for _, row := range rows {
+			var s Session
+			var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+			if err := dec.Decode(&s); err != nil {
+				return collected, err
+			}
+			s.Tenant = t.Name
+			if s.Expires > now {
+				continue
+			}
+			var aborted bool
+			err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+				// the session may have been written to since the scan
+				aborted = false
+				if err := s.get(txn); err != nil || s.Expires > now {
+					return err
+				}
+				aborted = true
+				return s.abort(txn)
+			})
+			if err != nil && err != SESSION_NOT_FOUND {
+				return collected, err
+			}
+			if err == nil && aborted {
+				collected = collected + 1
+			}
+		}
+		if len(rows) < 100 {
+			return collected, nil
+		}
+		start = rows[len(rows)-1].Key.Next()
+	}
+}
+
+// abort releases the chunks of the session and deletes it
+func (s *Session) abort(txn *client.KV) error {
+	for i := 0; i < s.Primitive.Chunks; i++ {
+		if err := s.Primitive.ns().releaseChunk(txn, s.Primitive.Tier, s.Primitive.ref(i)); err != nil {
+			return err
+		}
+	}
+	return s.del(txn)
+}
+
+func (s *Session) get(kv *client.KV) error {
+	if s.Id == "" || len(s.Id) != 32 {
+		return errors.New(fmt.Sprintf("Invalid session id:%s", s.Id))
+	}
+	var session Session
+	err := getRecord(kv, s.key(), &session)
+	if err == NOT_FOUND {
+		return SESSION_NOT_FOUND
+	} else if err != nil {
+		return err
+	}
+	session.Actor, session.Groups, session.Tenant = s.Actor, s.Groups, s.Tenant
+	session.Primitive.Actor, session.Primitive.Groups, session.Primitive.Tenant = s.Actor, s.Groups, s.Tenant
+	*s = session
+	return nil
+}
+
+func (s *Session) key() proto.Key {
+	return proto.Key(tenantNamed(s.Tenant).sessionDb + s.Id)
+}
+
+// put stores the session, renewing its expiry
+func (s *Session) put(kv *client.KV) error {
+	s.Expires = time.Now().Add(SESSION_TTL).Unix()
+	return putRecord(kv, s.key(), s)
+}
+
+func (s *Session) del(kv *client.KV) error {
+	delReq := &proto.DeleteRequest{}
+	delReq.Key = s.key()
+	delResp := &proto.DeleteResponse{}
+	return kv.Call(proto.Delete, delReq, delResp)
+}
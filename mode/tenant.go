@@ -0,0 +1,208 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Tenants keep their primitives apart. Every key of a tenant, from the
+// meta data and chunks of its primitives to its indexes, sessions, event
+// feed and audit log, is under a prefix of its own, so the id of a
+// primitive of one tenant resolves to nothing in another. Chunks stored by
+// content hash are only shared within a tenant. Each tenant has its own
+// Options, so chunk size, compression, encryption keys and the rest can
+// differ from one tenant to another.
+//
+// The default tenant, named "", keeps the "primitive:" prefix; SetOptions
+// and the package functions act on it. Other tenants are registered with
+// RegisterTenant, and their keys are under "tenant:<name>:". A primitive,
+// session or multipart upload belongs to the tenant named by its Tenant
+// field, which is not stored, so it has to be given with the id.
+
+// Tenant is a namespace of primitives with options of its own
+type Tenant struct {
+	Name    string
+	options Options
+
+	// key prefixes
+	pdb          string
+	metaDb       string
+	refDb        string
+	sessionDb    string
+	multipartDb  string
+	jobDb        string
+	digestDb     string
+	packDb       string
+	packDataDb   string
+	tierGcDb     string
+	expiryDb     string
+	trashDb      string
+	eventDb      string
+	auditDb      string
+	auditIdDb    string
+	revisionDb   string
+	webhookDb    string
+	retryDb      string
+	deadLetterDb string
+}
+
+// tenantsMu guards tenants and the options of every tenant, which may be
+// changed while primitives are being stored
+var tenantsMu sync.RWMutex
+var tenants = make(map[string]*Tenant)
+
+// defaultTenant is the tenant named ""
+var defaultTenant *Tenant
+
+// newTenant returns a tenant named name keeping its keys under pdb
+func newTenant(name, pdb string) *Tenant {
+	return &Tenant{
+		Name:         name,
+		pdb:          pdb,
+		metaDb:       pdb + "meta:",
+		refDb:        pdb + "ref:",
+		sessionDb:    pdb + "session:",
+		multipartDb:  pdb + "multipart:",
+		jobDb:        pdb + "job:",
+		digestDb:     pdb + "digest:",
+		packDb:       pdb + "pack:",
+		packDataDb:   pdb + "packdata:",
+		tierGcDb:     pdb + "tiergc:",
+		expiryDb:     pdb + "expiry:",
+		trashDb:      pdb + "trash:",
+		eventDb:      pdb + "event:",
+		auditDb:      pdb + "audit:",
+		auditIdDb:    pdb + "auditid:",
+		revisionDb:   pdb + "revision:",
+		webhookDb:    pdb + "webhook:",
+		retryDb:      pdb + "retry:",
+		deadLetterDb: pdb + "deadletter:",
+	}
+}
+
+// RegisterTenant adds a tenant named name storing primitives according to
+// o, or changes the options of the tenant if it is already registered
+func RegisterTenant(name string, o Options) (*Tenant, error) {
+	if name == "" || !validTenant(name) {
+		return nil, errors.New(fmt.Sprintf("invalid tenant name %q", name))
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	t, ok := tenants[name]
+	if !ok {
+		t = newTenant(name, "tenant:"+name+":")
+		tenants[name] = t
+	}
+	t.options = o
+	return t, nil
+}
+
+// LookupTenant returns the tenant registered under name, or the default
+// tenant if name is ""
+func LookupTenant(name string) (*Tenant, error) {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	t, ok := tenants[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown tenant %s", name))
+	}
+	return t, nil
+}
+
+// Tenants returns every tenant, the default tenant first and the rest in
+// order of name
+func Tenants() []*Tenant {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	all := make([]*Tenant, len(names))
+	for i, name := range names {
+		all[i] = tenants[name]
+	}
+	return all
+}
+
+// SetOptions changes how primitives of t made from now on are stored. The
+// key provider is also used to read primitives of t that are already
+// encrypted, so it must keep every master key that is still in use.
+func (t *Tenant) SetOptions(o Options) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	tenantsMu.Lock()
+	defer tenantsMu.Unlock()
+	t.options = o
+	return nil
+}
+
+// opts returns the options of t
+func (t *Tenant) opts() Options {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return t.options
+}
+
+// ns returns the tenant p belongs to. A tenant that isn't registered has
+// nothing stored, and is refused by prepare, so nothing is ever stored
+// under it.
+func (p *Primitive) ns() *Tenant {
+	return tenantNamed(p.Tenant)
+}
+
+// tenantNamed returns the tenant registered under name, or an empty one
+// with the same prefix if there is none. An invalid name gets a prefix no
+// tenant can have, so it can't reach into the keys of another tenant.
+func tenantNamed(name string) *Tenant {
+	tenantsMu.RLock()
+	t, ok := tenants[name]
+	tenantsMu.RUnlock()
+	if ok {
+		return t
+	}
+	if !validTenant(name) {
+		return newTenant(name, "tenant:|")
+	}
+	return newTenant(name, "tenant:"+name+":")
+}
+
+// validTenant reports whether name may name a tenant, which it can't if
+// its prefix would be part of the prefix of another
+func validTenant(name string) bool {
+	return !strings.ContainsAny(name, ":|")
+}
@@ -0,0 +1,337 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The chunks of a primitive, and its parity chunks, may be kept in a tier
+// rather than in cockroach, while its meta data, reference counts and the
+// indexes stay where they are. The tier is named in the meta data, so it
+// must stay registered for as long as primitives stored in it exist.
+// Inline and packed contents are never tiered.
+//
+// A tier can't take part in cockroach transactions, which may be retried
+// or abandoned. Chunks are put into a tier under keys no other write will
+// use, so a put by a transaction that never commits leaves nothing worse
+// than an unreferenced chunk. Chunks are never deleted from a tier inside a
+// transaction: releasing the last reference queues the chunk, and
+// CollectTiers deletes queued chunks once the release has committed.
+//
+// Tiers are shared by every tenant, so a chunk is kept in a tier under its
+// key in cockroach, prefix and all. The default tenant is the exception:
+// its chunks were tiered before there were tenants, under their refs
+// alone, and still are.
+
+// Tier stores chunk values by key outside of cockroach
+type Tier interface {
+	Name() string
+	Get(key string) ([]byte, error) // nil, and no error, if there is no such chunk
+	Put(key string, value []byte) error
+	Delete(key string) error // deleting a chunk that isn't there is not an error
+}
+
+var tiers = make(map[string]Tier)
+
+// RegisterTier makes a tier available for Options.Tier and for reading
+// primitives stored in it
+func RegisterTier(t Tier) {
+	tiers[t.Name()] = t
+}
+
+// DirTier is a tier keeping each chunk in a file of its own under Dir
+type DirTier struct {
+	TierName string
+	Dir      string
+}
+
+// NewDirTier returns a tier named name keeping chunks under dir, which is
+// created if need be
+func NewDirTier(name, dir string) (*DirTier, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirTier{TierName: name, Dir: dir}, nil
+}
+
+func (t *DirTier) Name() string {
+	return t.TierName
+}
+
+// path returns the file holding the chunk with the given key. Keys are
+// made of ids, padded numbers, colons and tenant names, whose spaces,
+// colons and separators are dropped, replaced or escaped so the name is
+// safe on any filesystem and stays in Dir.
+func (t *DirTier) path(key string) string {
+	return filepath.Join(t.Dir, pathEscaper.Replace(key))
+}
+
+var pathEscaper = strings.NewReplacer(" ", "", ":", "-", "%", "%25", "/", "%2F", "\\", "%5C")
+
+func (t *DirTier) Get(key string) ([]byte, error) {
+	value, err := ioutil.ReadFile(t.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Put writes the chunk to a temporary file first, so a reader never sees
+// part of a chunk. The file, and then the directory, are synced before
+// Put returns, so a chunk the meta data refers to survives a crash.
+func (t *DirTier) Put(key string, value []byte) error {
+	f, err := ioutil.TempFile(t.Dir, ".put-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), t.path(key)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	dir, err := os.Open(t.Dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (t *DirTier) Delete(key string) error {
+	err := os.Remove(t.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// lookupTier returns the tier registered under name
+func lookupTier(name string) (Tier, error) {
+	t, ok := tiers[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown tier %s", name))
+	}
+	return t, nil
+}
+
+// tierFor returns the tier a new primitive of t of length bytes is stored
+// in, where a length of 0 is not known yet
+func (t *Tenant) tierFor(length int) string {
+	options := t.opts()
+	if options.Tier == "" || (length > 0 && length < options.TierOver) {
+		return ""
+	}
+	return options.Tier
+}
+
+// getStored reads the chunk value of t stored under ref in the named tier,
+// or in cockroach if the tier is "". A missing chunk is returned as nil.
+func (t *Tenant) getStored(kv *client.KV, tier, ref string) ([]byte, error) {
+	if tier != "" {
+		store, err := lookupTier(tier)
+		if err != nil {
+			return nil, err
+		}
+		return store.Get(t.tierKey(ref))
+	}
+	getResp := &proto.GetResponse{}
+	if err := kv.Call(proto.Get, proto.GetArgs(proto.Key(t.pdb+ref)), getResp); err != nil {
+		return nil, err
+	}
+	if getResp.Value == nil {
+		return nil, nil
+	}
+	return getResp.Value.Bytes, nil
+}
+
+// putStored writes a chunk value of t under ref in the named tier, or in
+// cockroach if the tier is ""
+func (t *Tenant) putStored(kv *client.KV, tier, ref string, value []byte) error {
+	if tier != "" {
+		store, err := lookupTier(tier)
+		if err != nil {
+			return err
+		}
+		return store.Put(t.tierKey(ref), value)
+	}
+	putResp := &proto.PutResponse{}
+	return kv.Call(proto.Put, proto.PutArgs(proto.Key(t.pdb+ref), value), putResp)
+}
+
+// deleteStored deletes the chunk of t stored under ref in cockroach, or
+// queues it for deletion from the named tier
+func (t *Tenant) deleteStored(kv *client.KV, tier, ref string) error {
+	if tier != "" {
+		return putRecord(kv, proto.Key(t.tierGcDb+ref), &tierDeletion{Tier: tier})
+	}
+	delReq := &proto.DeleteRequest{}
+	delReq.Key = proto.Key(t.pdb + ref)
+	delResp := &proto.DeleteResponse{}
+	return kv.Call(proto.Delete, delReq, delResp)
+}
+
+// tierKey returns the key the chunk of t stored under ref has in a tier
+func (t *Tenant) tierKey(ref string) string {
+	if t.Name == "" {
+		return ref
+	}
+	return t.pdb + ref
+}
+
+// tierDeletion is queued under the key of a chunk no longer referenced
+type tierDeletion struct {
+	Tier string `json:"tier"`
+}
+
+// MoveTier moves the chunks of the primitive with id p.Id to the named
+// tier, or back into cockroach if name is "". Chunks shared with clones
+// are copied, as the clones stay where they are.
+func (p *Primitive) MoveTier(name string) error {
+	defer timeTrack(time.Now(), "primitive.MoveTier")
+	if name != "" {
+		if _, err := lookupTier(name); err != nil {
+			return err
+		}
+	}
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.getMeta(txn); err != nil {
+			return err
+		}
+		if err := p.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if p.Tier == name {
+			return nil
+		}
+		// chunks stored by content hash are shared through cockroach
+		if p.Dedup && name != "" {
+			return errors.New("deduplicated primitives can't be tiered")
+		}
+		if p.Data != nil || p.Pack != "" {
+			p.Tier = name
+			return p.putMeta(txn)
+		}
+		old := *p
+		old.Refs = make([]string, p.Chunks)
+		for i := range old.Refs {
+			old.Refs[i] = p.ref(i)
+		}
+		p.cow()
+		p.Tier = name
+		for i := 0; i < p.Chunks; i++ {
+			buf, err := old.getChunk(txn, i)
+			if err != nil {
+				return err
+			}
+			ref, err := p.putChunk(txn, p.genRef(i), buf)
+			if err != nil {
+				return err
+			}
+			if err := p.ns().releaseChunk(txn, old.Tier, old.Refs[i]); err != nil {
+				return err
+			}
+			p.Refs[i] = ref
+		}
+		// parity is computed afresh in the new tier by putMeta
+		if err := old.releaseParity(txn, 0); err != nil {
+			return err
+		}
+		p.Stripes = nil
+		return p.putMeta(txn)
+	})
+}
+
+// CollectTiers deletes the chunks of the default tenant queued for
+// deletion from their tiers, returning the number deleted
+func CollectTiers() (int, error) {
+	return defaultTenant.CollectTiers()
+}
+
+// CollectTiers deletes the chunks of t queued for deletion from their
+// tiers, returning the number deleted. Chunks of tiers no longer
+// registered are left queued.
+func (t *Tenant) CollectTiers() (int, error) {
+	defer timeTrack(time.Now(), "CollectTiers")
+	var deleted int
+	start := proto.Key(t.tierGcDb)
+	end := start.PrefixEnd()
+	for {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return deleted, err
+		}
+		if len(rows) == 0 {
+			return deleted, nil
+		}
+		for _, row := range rows {
+			start = row.Key.Next()
+			var queued tierDeletion
+			var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+			if err := dec.Decode(&queued); err != nil {
+				return deleted, err
+			}
+			store, ok := tiers[queued.Tier]
+			if !ok {
+				continue
+			}
+			// the queue entry goes last, so a failure leaves it to retry
+			if err := store.Delete(t.tierKey(strings.TrimPrefix(string(row.Key), t.tierGcDb))); err != nil {
+				return deleted, err
+			}
+			delReq := &proto.DeleteRequest{}
+			delReq.Key = row.Key
+			delResp := &proto.DeleteResponse{}
+			if err := kvClient.Call(proto.Delete, delReq, delResp); err != nil {
+				return deleted, err
+			}
+			deleted = deleted + 1
+		}
+	}
+}
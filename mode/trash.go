@@ -0,0 +1,254 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/ugorji/go/codec"
+	"strings"
+	"time"
+)
+
+// With Options.TrashDays set, Destroy puts a primitive in the trash rather
+// than destroying it. A primitive in the trash is not found by any
+// operation but Restore and Purge, and keeps its chunks until PurgeTrash
+// destroys it, once it has been there for TrashDays. Primitives are
+// indexed by the time they were put in the trash, so the purge need only
+// look at those that are due.
+
+// Trash puts the primitive with id p.Id in the trash
+func (p *Primitive) Trash() error {
+	defer timeTrack(time.Now(), "primitive.Trash")
+	err := p.trash()
+	return p.audit(AUDIT_TRASH, p.Length, err)
+}
+
+func (p *Primitive) trash() error {
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.getMeta(txn); err != nil {
+			return err
+		}
+		if err := p.allow(PERM_DELETE); err != nil {
+			return err
+		}
+		if p.locked(time.Now()) {
+			return LOCKED
+		}
+		p.Trashed = time.Now().UTC().Format(time.RFC3339)
+		return p.putMeta(txn)
+	})
+}
+
+// Restore takes the primitive with id p.Id out of the trash, returning
+// NOT_FOUND if it isn't there
+func (p *Primitive) Restore() error {
+	defer timeTrack(time.Now(), "primitive.Restore")
+	err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.readMeta(txn); err != nil {
+			return err
+		}
+		if p.Trashed == "" {
+			return NOT_FOUND
+		}
+		if err := p.allow(PERM_DELETE); err != nil {
+			return err
+		}
+		p.Trashed = ""
+		return p.putMeta(txn)
+	})
+	return p.audit(AUDIT_RESTORE, p.Length, err)
+}
+
+// Purge destroys the primitive with id p.Id, in the trash or not, at once,
+// unless it is locked
+func (p *Primitive) Purge() error {
+	defer timeTrack(time.Now(), "primitive.Purge")
+	err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.readMeta(txn); err != nil {
+			return err
+		}
+		if err := p.allow(PERM_DELETE); err != nil {
+			return err
+		}
+		return p.destroy(txn)
+	})
+	return p.audit(AUDIT_PURGE, p.Length, err)
+}
+
+// PurgeTrash purges the trash of the default tenant
+func PurgeTrash() (int, error) {
+	return defaultTenant.PurgeTrash()
+}
+
+// PurgeTrash destroys every primitive of t that has been in the trash for
+// the TrashDays of its options, returning the number destroyed
+func (t *Tenant) PurgeTrash() (int, error) {
+	defer timeTrack(time.Now(), "PurgeTrash")
+	var purged int
+	due := time.Now().Add(-time.Duration(t.opts().TrashDays) * 24 * time.Hour).UTC().Format(time.RFC3339)
+	start := proto.Key(t.trashDb)
+	end := proto.Key(t.trashDb + due + "|").PrefixEnd()
+	for {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return purged, err
+		}
+		if len(rows) == 0 {
+			return purged, nil
+		}
+		for _, row := range rows {
+			start = row.Key.Next()
+			p := &Primitive{Id: string(row.Key)[strings.LastIndex(string(row.Key), "|")+1:], Tenant: t.Name}
+			err := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+				if err := p.readMeta(txn); err != nil {
+					return err
+				}
+				// it may have been restored since the scan
+				if p.Trashed == "" || p.Trashed > due {
+					return NOT_FOUND
+				}
+				return p.destroy(txn)
+			})
+			if err == NOT_FOUND || err == LOCKED {
+				continue
+			} else if err != nil {
+				return purged, err
+			}
+			p.audit(AUDIT_PURGE, p.Length, nil)
+			purged = purged + 1
+		}
+	}
+}
+
+// destroy deletes p, its index entries and its revisions, and releases
+// its chunks, unless p is locked
+func (p *Primitive) destroy(txn *client.KV) error {
+	if p.locked(time.Now()) {
+		return LOCKED
+	}
+	if err := p.releaseChunks(txn); err != nil {
+		return err
+	}
+	if err := p.dropRevisions(txn); err != nil {
+		return err
+	}
+	if err := p.unindex(txn); err != nil {
+		return err
+	}
+	delReq := &proto.DeleteRequest{}
+	delReq.Key = p.ns().metaKey(p.Id)
+	return txn.Call(proto.Delete, delReq, &proto.DeleteResponse{})
+}
+
+// hidden reports whether p is treated as not found, because it is in the
+// trash, or has expired and is not locked
+func (p *Primitive) hidden(now time.Time) bool {
+	return p.Trashed != "" || (p.expired(now) && !p.locked(now))
+}
+
+// trashKey separates the time from the id like expiryKey
+func (p *Primitive) trashKey() proto.Key {
+	return proto.Key(p.ns().trashDb + p.Trashed + "|" + p.Id)
+}
+
+// indexTrash moves the trash index entry of p from that of old
+func (p *Primitive) indexTrash(kv *client.KV, old *Primitive) error {
+	if old.Trashed == p.Trashed {
+		return nil
+	}
+	if old.Trashed != "" {
+		delReq := &proto.DeleteRequest{}
+		delReq.Key = old.trashKey()
+		if err := kv.Call(proto.Delete, delReq, &proto.DeleteResponse{}); err != nil {
+			return err
+		}
+	}
+	if p.Trashed == "" {
+		return nil
+	}
+	putResp := &proto.PutResponse{}
+	return kv.Call(proto.Put, proto.PutArgs(p.trashKey(), []byte(p.Id)), putResp)
+}
+
+// List lists the primitives of the default tenant
+func List(after string, max int) ([]*Primitive, error) {
+	return defaultTenant.list(after, max, false)
+}
+
+// ListTrash lists the primitives in the trash of the default tenant
+func ListTrash(after string, max int) ([]*Primitive, error) {
+	return defaultTenant.list(after, max, true)
+}
+
+// List returns up to max primitives of t, in order of id, starting after
+// the id after, or from the first if it is "". Primitives that have
+// expired or are in the trash are left out.
+func (t *Tenant) List(after string, max int) ([]*Primitive, error) {
+	return t.list(after, max, false)
+}
+
+// ListTrash returns up to max primitives of t in the trash, like List
+func (t *Tenant) ListTrash(after string, max int) ([]*Primitive, error) {
+	return t.list(after, max, true)
+}
+
+func (t *Tenant) list(after string, max int, trashed bool) ([]*Primitive, error) {
+	defer timeTrack(time.Now(), "List")
+	var found []*Primitive
+	now := time.Now()
+	start := proto.Key(t.metaDb)
+	if after != "" {
+		start = t.metaKey(after).Next()
+	}
+	end := proto.Key(t.metaDb).PrefixEnd()
+	for len(found) < max {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			start = row.Key.Next()
+			p := &Primitive{Tenant: t.Name}
+			var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+			if err := dec.Decode(p); err != nil {
+				return nil, err
+			}
+			if (p.Trashed != "") != trashed || (p.expired(now) && !p.locked(now)) {
+				continue
+			}
+			found = append(found, p)
+			if len(found) == max {
+				break
+			}
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/ugorji/go/codec"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A webhook posts events from the feed, as JSON, to a URL. Each request is
+// signed with an HMAC-SHA256 of its body under the webhook's secret, sent
+// hex encoded in the X-Roachclip-Signature header as "sha256=<hmac>", so
+// the receiver can check it came from us. An event the receiver doesn't
+// accept with a 2xx status is queued to be retried, and delivery goes on
+// with the events after it, so one event can't hold up the rest. A queued
+// event is retried by the first delivery at least Backoff after it
+// failed, then twice as long after each failure after, and once the
+// retries run out it is recorded as a dead letter. Retried events can
+// therefore arrive out of order, which their number in the
+// X-Roachclip-Delivery header shows. The webhook's place in the feed is
+// stored under its name, so delivery resumes where it left off.
+
+// Webhook delivers events to URL
+type Webhook struct {
+	Name    string        // names the place in the feed and the dead letters of the webhook
+	URL     string        // where events are posted
+	Secret  string        // key of the signature
+	Types   []string      // kinds of event delivered, every kind if empty
+	Retries int           // attempts after the first before an event is dead lettered
+	Backoff time.Duration // wait before the first retry
+	Client  *http.Client  // client to post with, nil for one that gives up after 30 seconds
+	Tenant  string        // tenant whose feed is delivered, "" for the default tenant
+}
+
+// webhookClient posts for webhooks without a client of their own, so a
+// receiver that never answers can't stall delivery
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// DeadLetter is an event that could not be delivered, as of Time, or one
+// queued to be retried
+type DeadLetter struct {
+	Event    Event  `json:"event"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	Time     string `json:"time"`
+}
+
+// Sign returns the signature of body under secret, as sent by webhooks
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// check returns an error unless the webhook has a name that can't be
+// confused with another's: the name is followed by the key separator in
+// the keys of its records
+func (w *Webhook) check() error {
+	if w.Name == "" {
+		return MISSING_ARG
+	}
+	if strings.Contains(w.Name, ":") {
+		return errors.New(fmt.Sprintf("invalid webhook name %q", w.Name))
+	}
+	return nil
+}
+
+func (w *Webhook) cursorKey() proto.Key {
+	return proto.Key(tenantNamed(w.Tenant).webhookDb + w.Name)
+}
+
+// retryKey and deadLetterKey order the events of a webhook by number
+func (w *Webhook) retryKey(seq int64) proto.Key {
+	return proto.Key(fmt.Sprintf("%s%s:%020d", tenantNamed(w.Tenant).retryDb, w.Name, seq))
+}
+
+func (w *Webhook) deadLetterKey(seq int64) proto.Key {
+	return proto.Key(fmt.Sprintf("%s%s:%020d", tenantNamed(w.Tenant).deadLetterDb, w.Name, seq))
+}
+
+// Deliver retries the queued events that are due, and delivers every event
+// recorded since the last delivery, returning the number delivered. Each
+// event is posted once; one that fails is queued to be retried, or dead
+// lettered if the webhook has no retries.
+func (w *Webhook) Deliver() (int, error) {
+	if w.URL == "" {
+		return 0, MISSING_ARG
+	}
+	if err := w.check(); err != nil {
+		return 0, err
+	}
+	delivered, err := w.retry()
+	if err != nil {
+		return delivered, err
+	}
+	var cursor int64
+	if err := getRecord(kvClient, w.cursorKey(), &cursor); err != nil && err != NOT_FOUND {
+		return delivered, err
+	}
+	for {
+		events, err := tenantNamed(w.Tenant).ReadEvents(cursor, 100)
+		if err != nil {
+			return delivered, err
+		}
+		if len(events) == 0 {
+			return delivered, nil
+		}
+		for _, e := range events {
+			if w.wants(e.Type) {
+				if err := w.post(&e); err == nil {
+					delivered = delivered + 1
+				} else if err := w.failed(&DeadLetter{Event: e}, err); err != nil {
+					return delivered, err
+				}
+			}
+			cursor = e.Seq
+			if err := putRecord(kvClient, w.cursorKey(), cursor); err != nil {
+				return delivered, err
+			}
+		}
+	}
+}
+
+// retry posts each queued event whose wait is over, returning the number
+// delivered
+func (w *Webhook) retry() (int, error) {
+	letters, err := w.letters(w.retryKey(0))
+	if err != nil {
+		return 0, err
+	}
+	var delivered int
+	now := time.Now()
+	for _, queued := range letters {
+		last, err := time.Parse(time.RFC3339Nano, queued.Time)
+		if err != nil {
+			return delivered, err
+		}
+		if now.Before(last.Add(w.Backoff << uint(queued.Attempts-1))) {
+			continue
+		}
+		if err := w.post(&queued.Event); err != nil {
+			if err := w.failed(&queued, err); err != nil {
+				return delivered, err
+			}
+			if queued.Attempts <= w.Retries {
+				continue
+			}
+		} else {
+			delivered = delivered + 1
+		}
+		delReq := &proto.DeleteRequest{}
+		delReq.Key = w.retryKey(queued.Event.Seq)
+		if err := kvClient.Call(proto.Delete, delReq, &proto.DeleteResponse{}); err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// failed records a failed attempt to post the event of dead, queueing it
+// to be retried, or dead lettering it once the retries have run out
+func (w *Webhook) failed(dead *DeadLetter, err error) error {
+	dead.Error, dead.Attempts = err.Error(), dead.Attempts+1
+	dead.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	if dead.Attempts > w.Retries {
+		return putRecord(kvClient, w.deadLetterKey(dead.Event.Seq), dead)
+	}
+	return putRecord(kvClient, w.retryKey(dead.Event.Seq), dead)
+}
+
+// Run delivers events as they are recorded, checking for new ones and for
+// retries that are due every interval, until stop is closed
+func (w *Webhook) Run(every time.Duration, stop <-chan struct{}) error {
+	for {
+		if _, err := w.Deliver(); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(every):
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// wants reports whether the webhook delivers events of the given kind
+func (w *Webhook) wants(kind string) bool {
+	if len(w.Types) == 0 {
+		return true
+	}
+	for _, t := range w.Types {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// post posts e once, returning an error unless the receiver accepts it
+func (w *Webhook) post(e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	client := w.Client
+	if client == nil {
+		client = webhookClient
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Roachclip-Event", e.Type)
+	req.Header.Set("X-Roachclip-Delivery", strconv.FormatInt(e.Seq, 10))
+	req.Header.Set("X-Roachclip-Signature", Sign(w.Secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("%s answered %s", w.URL, resp.Status))
+	}
+	return nil
+}
+
+// DeadLetters returns the events the webhook couldn't deliver, in order
+func (w *Webhook) DeadLetters() ([]DeadLetter, error) {
+	if err := w.check(); err != nil {
+		return nil, err
+	}
+	return w.letters(w.deadLetterKey(0))
+}
+
+// Queued returns the events waiting to be retried, in order
+func (w *Webhook) Queued() ([]DeadLetter, error) {
+	if err := w.check(); err != nil {
+		return nil, err
+	}
+	return w.letters(w.retryKey(0))
+}
+
+// letters returns the records of the webhook in the subspace of first,
+// the key of event number 0
+func (w *Webhook) letters(first proto.Key) ([]DeadLetter, error) {
+	start := first[:len(first)-20]
+	end := start.PrefixEnd()
+	var letters []DeadLetter
+	for {
+		rows, err := scan(kvClient, start, end, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			var dead DeadLetter
+			var dec *codec.Decoder = codec.NewDecoderBytes(row.Value.Bytes, mph)
+			if err := dec.Decode(&dead); err != nil {
+				return nil, err
+			}
+			letters = append(letters, dead)
+		}
+		if len(rows) < 100 {
+			return letters, nil
+		}
+		start = rows[len(rows)-1].Key.Next()
+	}
+}
+
+// Redeliver posts the dead letters of the webhook once more, deleting
+// those that are delivered, and returns the number delivered
+func (w *Webhook) Redeliver() (int, error) {
+	letters, err := w.DeadLetters()
+	if err != nil {
+		return 0, err
+	}
+	var delivered int
+	for _, dead := range letters {
+		if err := w.post(&dead.Event); err != nil {
+			dead.Error, dead.Attempts = err.Error(), dead.Attempts+1
+			dead.Time = time.Now().UTC().Format(time.RFC3339Nano)
+			if err := putRecord(kvClient, w.deadLetterKey(dead.Event.Seq), &dead); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		delReq := &proto.DeleteRequest{}
+		delReq.Key = w.deadLetterKey(dead.Event.Seq)
+		if err := kvClient.Call(proto.Delete, delReq, &proto.DeleteResponse{}); err != nil {
+			return delivered, err
+		}
+		delivered = delivered + 1
+	}
+	return delivered, nil
+}
@@ -0,0 +1,373 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"time"
+)
+
+// Writes and truncates never modify a chunk in place. Each operation bumps
+// the primitive's generation, writes the affected chunks under new keys
+// named for that generation, and swaps the chunk list in the meta data in
+// the same transaction that releases the replaced chunks. A reader holding
+// the old meta data therefore either sees the old version in full, or
+// finds a chunk missing and stops with CHANGED; it never sees a mix.
+//
+// A write in the middle of a primitive invalidates its digest, which would
+// take reading the whole primitive to recompute. Unless identical files are
+// deduplicated, which needs the digest, writes leave it empty instead, and
+// Rehash recomputes it when it is wanted.
+
+// WriteAt writes b into the primitive starting at byte offset off,
+// replacing existing bytes and growing the primitive as needed. Writing
+// beyond the current end fills the gap with zeros. Only the chunks
+// covering the written range are rewritten.
+func (p *Primitive) WriteAt(b []byte, off int64) (int, error) {
+	defer timeTrack(time.Now(), "primitive.WriteAt")
+	if off < 0 {
+		return 0, errors.New(fmt.Sprintf("negative offset %d", off))
+	}
+	e := kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		err := p.getMeta(txn) // p is now filled out
+		if err != nil {
+			return err
+		}
+		if err := p.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if p.locked(time.Now()) {
+			return LOCKED
+		}
+		if err := p.spill(txn); err != nil {
+			return err
+		}
+		if err := p.keepRevision(txn); err != nil {
+			return err
+		}
+		p.cow()
+		if int(off) > p.Length {
+			if err := p.grow(txn, int(off)); err != nil {
+				return err
+			}
+		}
+		if err := p.splice(txn, int(off), b); err != nil {
+			return err
+		}
+		if err := p.staleDigest(txn); err != nil {
+			return err
+		}
+		return p.putMeta(txn)
+	})
+	if e := p.audit(AUDIT_WRITE, len(b), e); e != nil {
+		return 0, e
+	}
+	return len(b), nil
+}
+
+// Truncate changes the length of the primitive to size bytes. Shrinking
+// releases the chunks past the new end and rewrites the new last chunk if
+// it is cut short; growing fills the new bytes with zeros.
+func (p *Primitive) Truncate(size int64) error {
+	defer timeTrack(time.Now(), "primitive.Truncate")
+	if size < 0 {
+		return errors.New(fmt.Sprintf("negative size %d", size))
+	}
+	return p.audit(AUDIT_TRUNCATE, int(size), kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		err := p.getMeta(txn) // p is now filled out
+		if err != nil {
+			return err
+		}
+		if err := p.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if p.locked(time.Now()) {
+			return LOCKED
+		}
+		if err := p.spill(txn); err != nil {
+			return err
+		}
+		if err := p.keepRevision(txn); err != nil {
+			return err
+		}
+		p.cow()
+		if int(size) > p.Length {
+			if err := p.grow(txn, int(size)); err != nil {
+				return err
+			}
+		} else if int(size) < p.Length {
+			if err := p.shrink(txn, int(size)); err != nil {
+				return err
+			}
+		}
+		if err := p.staleDigest(txn); err != nil {
+			return err
+		}
+		return p.putMeta(txn)
+	}))
+}
+
+// cow prepares p for a copy-on-write: the chunk keys are listed in Refs if
+// they weren't already and a new generation is started
+func (p *Primitive) cow() {
+	if p.CSize == 0 {
+		p.CSize = CHUNK_SIZE
+	}
+	if p.Refs == nil {
+		p.Refs = make([]string, p.Chunks)
+		for i := range p.Refs {
+			p.Refs[i] = chunkRef(p.Id, i)
+		}
+	}
+	p.Gen = p.Gen + 1
+}
+
+// rewrite reads the contents of p, lets change alter how p is stored, and
+// writes the contents back that way, the chunks as a new generation
+func (p *Primitive) rewrite(txn *client.KV, change func() error) error {
+	if p.Data != nil || p.Pack != "" {
+		buf, err := p.getChunk(txn, 0)
+		if err != nil {
+			return err
+		}
+		if err := change(); err != nil {
+			return err
+		}
+		if p.Data != nil {
+			return p.putInline(buf)
+		}
+		// packed contents are packed again, as they are stored
+		if err := p.leavePack(txn); err != nil {
+			return err
+		}
+		return p.putPacked(txn, buf)
+	}
+	old := *p
+	p.cow()
+	old.Refs = append([]string(nil), p.Refs...)
+	if err := change(); err != nil {
+		return err
+	}
+	for i := 0; i < p.Chunks; i++ {
+		buf, err := old.getChunk(txn, i)
+		if err != nil {
+			return err
+		}
+		if err := p.replaceChunk(txn, i, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// genRef returns the key, less the primitive prefix, for chunk number n
+// written in the current generation
+func (p *Primitive) genRef(n int) string {
+	return fmt.Sprintf("%s:%10d:%d", p.Id, n, p.Gen)
+}
+
+// splice writes b at byte offset off, which must not be past the end of
+// the primitive, rewriting each chunk it touches under the current
+// generation. Bytes past the end of the primitive are added by extend.
+func (p *Primitive) splice(txn *client.KV, off int, b []byte) error {
+	end := off + len(b)
+	if off < p.Length {
+		n, start := p.locate(off, p.offsets())
+		for ; start < end && n < p.Chunks; n++ {
+			buf, err := p.getChunk(txn, n)
+			if err != nil {
+				return err
+			}
+			if off > start {
+				copy(buf[off-start:], b)
+			} else {
+				copy(buf, b[start-off:])
+			}
+			if err := p.replaceChunk(txn, n, buf); err != nil {
+				return err
+			}
+			start = start + len(buf)
+		}
+	}
+	if end > p.Length {
+		return p.extend(txn, b[p.Length-off:])
+	}
+	return nil
+}
+
+// extend adds b to the end of the primitive, topping up the last chunk to
+// p.CSize before adding new chunks
+func (p *Primitive) extend(txn *client.KV, b []byte) error {
+	if last := p.Chunks - 1; last >= 0 && p.size(last) < p.CSize && len(b) > 0 {
+		buf, err := p.getChunk(txn, last)
+		if err != nil {
+			return err
+		}
+		n := p.CSize - len(buf)
+		if len(b) < n {
+			n = len(b)
+		}
+		if err := p.replaceChunk(txn, last, append(buf, b[:n]...)); err != nil {
+			return err
+		}
+		p.Length = p.Length + n
+		b = b[n:]
+	}
+	for len(b) > 0 {
+		n := p.CSize
+		if len(b) < n {
+			n = len(b)
+		}
+		if err := p.replaceChunk(txn, p.Chunks, b[:n]); err != nil {
+			return err
+		}
+		p.Length = p.Length + n
+		b = b[n:]
+	}
+	return nil
+}
+
+// grow extends the primitive with zeros up to size bytes, a chunk at a time
+func (p *Primitive) grow(txn *client.KV, size int) error {
+	zeros := make([]byte, p.CSize)
+	for p.Length < size {
+		n := p.CSize
+		if size-p.Length < n {
+			n = size - p.Length
+		}
+		if err := p.extend(txn, zeros[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shrink cuts the primitive down to size bytes, releasing every chunk past
+// the new end and rewriting the last one if only part of it is kept
+func (p *Primitive) shrink(txn *client.KV, size int) error {
+	n, start := p.locate(size, p.offsets())
+	keep := n
+	if size > start {
+		keep = n + 1
+		buf, err := p.getChunk(txn, n)
+		if err != nil {
+			return err
+		}
+		if err := p.replaceChunk(txn, n, buf[:size-start]); err != nil {
+			return err
+		}
+	}
+	for i := keep; i < p.Chunks; i++ {
+		if err := p.ns().releaseChunk(txn, p.Tier, p.ref(i)); err != nil {
+			return err
+		}
+	}
+	p.Refs = p.Refs[:keep]
+	if p.Sizes != nil {
+		p.Sizes = p.Sizes[:keep]
+	}
+	p.Chunks = keep
+	p.Length = size
+	return nil
+}
+
+// replaceChunk writes buf as chunk number n under the current generation
+// and releases the chunk it replaces, if any. n may be p.Chunks, in which
+// case a new chunk is added.
+func (p *Primitive) replaceChunk(txn *client.KV, n int, buf []byte) error {
+	ref, err := p.putChunk(txn, p.genRef(n), buf)
+	if err != nil {
+		return err
+	}
+	if n == p.Chunks {
+		p.Refs = append(p.Refs, ref)
+		if p.Sizes != nil {
+			p.Sizes = append(p.Sizes, len(buf))
+		}
+		p.Chunks = p.Chunks + 1
+		return nil
+	}
+	// the same chunk may be written more than once in a generation, but
+	// every deduplicated write adds a reference
+	if old := p.Refs[n]; old != ref || p.Dedup {
+		if err := p.ns().releaseChunk(txn, p.Tier, old); err != nil {
+			return err
+		}
+	}
+	p.Refs[n] = ref
+	if p.Sizes != nil {
+		p.Sizes[n] = len(buf)
+	}
+	return nil
+}
+
+// staleDigest drops the digest of p, which a write has invalidated, or
+// recomputes it if identical files are deduplicated
+func (p *Primitive) staleDigest(txn *client.KV) error {
+	if p.ns().opts().DedupFiles {
+		return p.rehash(txn)
+	}
+	p.Md5, p.Sha256, p.Digest, p.ShaState = "", "", nil, nil
+	return nil
+}
+
+// Rehash recomputes the digest of the primitive with id p.Id if a write has
+// left it empty, reading every chunk
+func (p *Primitive) Rehash() error {
+	defer timeTrack(time.Now(), "primitive.Rehash")
+	return kvClient.RunTransaction(&client.TransactionOptions{Isolation: proto.SNAPSHOT}, func(txn *client.KV) error {
+		if err := p.getMeta(txn); err != nil {
+			return err
+		}
+		if err := p.allow(PERM_WRITE); err != nil {
+			return err
+		}
+		if p.Sha256 != "" {
+			return nil
+		}
+		if err := p.rehash(txn); err != nil {
+			return err
+		}
+		return p.putMeta(txn)
+	})
+}
+
+// rehash recomputes the digest from the stored chunks
+func (p *Primitive) rehash(txn *client.KV) error {
+	digest := newDigest()
+	for i := 0; i < p.Chunks; i++ {
+		buf, err := p.getChunk(txn, i)
+		if err != nil {
+			return err
+		}
+		digest.Write(buf)
+	}
+	return p.setDigest(digest)
+}
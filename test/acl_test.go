@@ -0,0 +1,158 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestAccess(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	// read streams the primitive with id as actor, a member of groups
+	read := func(id, actor string, groups ...string) ([]byte, error) {
+		p := mode.Primitive{Id: id, Actor: actor, Groups: groups}
+		var out bytes.Buffer
+		w := bufio.NewWriter(&out)
+		err := p.Stream(w)
+		w.Flush()
+		return out.Bytes(), err
+	}
+	Convey("Testing ownership and access control", t, func() {
+		data := bytes.Repeat([]byte("frame "), 50000)
+		primitive := mode.Primitive{Name: "clip.mov", MimeType: "video/quicktime", Length: len(data), Actor: "alice",
+			ACL: []mode.Grant{{Principal: "bob", Read: true}, {Principal: "group:editors", Read: true, Write: true}}}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("The actor owns what it makes", func() {
+			So(primitive.Owner, ShouldEqual, "alice")
+			found := mode.Primitive{Id: primitive.Id}
+			So(found.Find(), ShouldEqual, nil)
+			So(found.Owner, ShouldEqual, "alice")
+			So(found.ACL, ShouldResemble, primitive.ACL)
+		})
+		Convey("Reading needs a grant", func() {
+			b, err := read(primitive.Id, "alice")
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(b, data), ShouldBeTrue)
+			_, err = read(primitive.Id, "bob")
+			So(err, ShouldEqual, nil)
+			_, err = read(primitive.Id, "carol", "editors")
+			So(err, ShouldEqual, nil)
+			b, err = read(primitive.Id, "mallory", "viewers")
+			So(err, ShouldEqual, mode.FORBIDDEN)
+			So(len(b), ShouldEqual, 0)
+			_, err = (&mode.Primitive{Id: primitive.Id, Actor: "mallory"}).Open()
+			So(err, ShouldEqual, mode.FORBIDDEN)
+			_, err = (&mode.Primitive{Id: primitive.Id, Actor: "mallory"}).Clone()
+			So(err, ShouldEqual, mode.FORBIDDEN)
+		})
+		Convey("Writing needs a grant", func() {
+			bob := mode.Primitive{Id: primitive.Id, Actor: "bob"}
+			_, err := bob.WriteAt([]byte("title card"), 0)
+			So(err, ShouldEqual, mode.FORBIDDEN)
+			So(bob.Truncate(10), ShouldEqual, mode.FORBIDDEN)
+			So(bob.Rehash(), ShouldEqual, mode.FORBIDDEN)
+			So(bob.MoveTier(""), ShouldEqual, mode.FORBIDDEN)
+			So(bob.Recompress(""), ShouldEqual, mode.FORBIDDEN)
+			carol := mode.Primitive{Id: primitive.Id, Actor: "carol", Groups: []string{"editors"}}
+			_, err = carol.WriteAt([]byte("title card"), 0)
+			So(err, ShouldEqual, nil)
+			b, err := read(primitive.Id, "alice")
+			So(err, ShouldEqual, nil)
+			So(string(b[:10]), ShouldEqual, "title card")
+		})
+		Convey("Only the owner changes who has access", func() {
+			carol := mode.Primitive{Id: primitive.Id, Actor: "carol", Groups: []string{"editors"}}
+			So(carol.Find(), ShouldEqual, nil)
+			carol.Name = "clip-final.mov"
+			So(carol.SetMeta(), ShouldEqual, nil)
+			carol.ACL = append(carol.ACL, mode.Grant{Principal: "carol", Read: true, Write: true, Delete: true})
+			So(carol.SetMeta(), ShouldEqual, mode.FORBIDDEN)
+			carol.ACL, carol.Owner = primitive.ACL, "carol"
+			So(carol.SetMeta(), ShouldEqual, mode.FORBIDDEN)
+
+			primitive.Name = "clip-final.mov"
+			primitive.ACL = nil
+			So(primitive.SetMeta(), ShouldEqual, nil)
+			_, err := read(primitive.Id, "bob")
+			So(err, ShouldEqual, mode.FORBIDDEN)
+		})
+		Convey("Deleting needs a grant", func() {
+			carol := mode.Primitive{Id: primitive.Id, Actor: "carol", Groups: []string{"editors"}}
+			So(carol.Destroy(), ShouldEqual, mode.FORBIDDEN)
+			So(carol.Trash(), ShouldEqual, mode.FORBIDDEN)
+			So(carol.Purge(), ShouldEqual, mode.FORBIDDEN)
+			So((&mode.Primitive{Id: primitive.Id, Actor: "carol"}).DestroyMeta(), ShouldEqual, mode.FORBIDDEN)
+			So(carol.Find(), ShouldEqual, nil)
+			carol.Trashed = time.Now().UTC().Format(time.RFC3339)
+			So(carol.SetMeta(), ShouldEqual, mode.FORBIDDEN)
+			carol.Trashed, carol.Expires = "", time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+			So(carol.SetMeta(), ShouldEqual, mode.FORBIDDEN)
+			_, err := read(primitive.Id, "alice")
+			So(err, ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Meta data can't change how the contents are stored", func() {
+			other := mode.Primitive{Name: "other.mov", Length: 6, Actor: "carol"}
+			So(other.Make(bufio.NewReader(bytes.NewReader([]byte("other!")))), ShouldEqual, nil)
+			carol := mode.Primitive{Id: primitive.Id, Actor: "carol", Groups: []string{"editors"}}
+			So(carol.Find(), ShouldEqual, nil)
+			carol.Length, carol.Chunks, carol.Tier = other.Length, other.Chunks, "elsewhere"
+			carol.Name = "clip-final.mov"
+			So(carol.SetMeta(), ShouldEqual, nil)
+			So(carol.Length, ShouldEqual, len(data))
+			So(carol.Tier, ShouldEqual, "")
+			So(carol.Name, ShouldEqual, "clip-final.mov")
+			b, err := read(primitive.Id, "alice")
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(b, data), ShouldBeTrue)
+			So(other.Destroy(), ShouldEqual, nil)
+		})
+		Convey("A clone belongs to whoever made it", func() {
+			bob := mode.Primitive{Id: primitive.Id, Actor: "bob"}
+			clone, err := bob.Clone()
+			So(err, ShouldEqual, nil)
+			So(clone.Owner, ShouldEqual, "bob")
+			clone.Actor = "bob"
+			So(clone.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Without an actor nothing is checked", func() {
+			_, err := read(primitive.Id, "")
+			So(err, ShouldEqual, nil)
+			So((&mode.Primitive{Id: primitive.Id}).Destroy(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			(&mode.Primitive{Id: primitive.Id}).Destroy()
+		})
+	})
+}
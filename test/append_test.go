@@ -0,0 +1,97 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing Primitive.Append", t, func() {
+		// first write leaves a partial last chunk, the append fills it
+		// and spills over into new chunks
+		first := bytes.Repeat([]byte("a"), mode.CHUNK_SIZE+100)
+		second := bytes.Repeat([]byte("b"), mode.CHUNK_SIZE+200)
+
+		primitive := mode.Primitive{Name: "append.log", Length: len(first)}
+		err := primitive.Make(bufio.NewReader(bytes.NewReader(first)))
+		So(err, ShouldEqual, nil)
+		So(primitive.Chunks, ShouldEqual, 2)
+
+		Convey("Append bytes to the primitive", func() {
+			err := primitive.Append(bufio.NewReader(bytes.NewReader(second)), len(second))
+			So(err, ShouldEqual, nil)
+			So(primitive.Length, ShouldEqual, len(first)+len(second))
+			So(primitive.Chunks, ShouldEqual, 3)
+
+			sum := md5.Sum(append(append([]byte{}, first...), second...))
+			So(primitive.Md5, ShouldEqual, hex.EncodeToString(sum[:]))
+
+			Convey("Stream returns the original bytes followed by the appended bytes", func() {
+				var out bytes.Buffer
+				readPrimitive := mode.Primitive{Id: primitive.Id}
+				writer := bufio.NewWriter(&out)
+				err := readPrimitive.Stream(writer)
+				writer.Flush()
+				So(err, ShouldEqual, nil)
+				So(readPrimitive.Length, ShouldEqual, len(first)+len(second))
+				So(bytes.Equal(out.Bytes()[:len(first)], first), ShouldBeTrue)
+				So(bytes.Equal(out.Bytes()[len(first):], second), ShouldBeTrue)
+			})
+		})
+		Convey("Append fewer bytes than promised fails and leaves the primitive unchanged", func() {
+			err := primitive.Append(bufio.NewReader(bytes.NewReader(second[:10])), len(second))
+			So(err, ShouldNotEqual, nil)
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			So(readPrimitive.Find(), ShouldEqual, nil)
+			So(readPrimitive.Length, ShouldEqual, len(first))
+		})
+		Convey("Append of an unknown length is refused", func() {
+			err := primitive.Append(bufio.NewReader(bytes.NewReader(second)), -1)
+			So(err, ShouldEqual, mode.MISSING_ARG)
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			So(readPrimitive.Find(), ShouldEqual, nil)
+			So(readPrimitive.Length, ShouldEqual, len(first))
+		})
+		Convey("Append to a primitive that does not exist", func() {
+			missing := mode.Primitive{Id: "e64a919ef57c4481bcd5fba43f8efb9d"}
+			err := missing.Append(bufio.NewReader(bytes.NewReader(second)), len(second))
+			So(err, ShouldEqual, mode.NOT_FOUND)
+		})
+		Reset(func() {
+			primitive.Destroy()
+		})
+	})
+}
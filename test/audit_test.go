@@ -0,0 +1,220 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	kv := rawClient()
+	// ops returns the operations recorded on id since start
+	ops := func(id string, start time.Time) []string {
+		records, err := mode.ReadAuditOf(id, start, time.Now().Add(time.Second), 1000)
+		So(err, ShouldEqual, nil)
+		found := []string{}
+		for _, r := range records {
+			found = append(found, r.Op)
+		}
+		return found
+	}
+	Convey("Testing the audit log", t, func() {
+		So(mode.SetOptions(mode.Options{Audit: true}), ShouldEqual, nil)
+		start := time.Now()
+		data := bytes.Repeat([]byte("frame "), 50000)
+		primitive := mode.Primitive{Name: "clip.mov", MimeType: "video/quicktime", Length: len(data), Actor: "alice",
+			ACL: []mode.Grant{{Principal: "bob", Read: true}}}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("Operations are recorded with who did them", func() {
+			reader := mode.Primitive{Id: primitive.Id, Actor: "bob"}
+			var out bytes.Buffer
+			w := bufio.NewWriter(&out)
+			So(reader.Stream(w), ShouldEqual, nil)
+			w.Flush()
+			primitive.Name = "clip-final.mov"
+			So(primitive.SetMeta(), ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, nil)
+			So(ops(primitive.Id, start), ShouldResemble, []string{"make", "stream", "setmeta", "destroy"})
+
+			records, err := mode.ReadAuditOf(primitive.Id, start, time.Now().Add(time.Second), 1000)
+			So(err, ShouldEqual, nil)
+			So(records[0].Actor, ShouldEqual, "alice")
+			So(records[0].Bytes, ShouldEqual, len(data))
+			So(records[0].Result, ShouldEqual, "ok")
+			So(records[1].Actor, ShouldEqual, "bob")
+			So(records[1].Bytes, ShouldEqual, out.Len())
+			So(records[3].Bytes, ShouldEqual, len(data))
+		})
+		Convey("Reads and changes of the contents are recorded", func() {
+			reader := mode.Primitive{Id: primitive.Id, Actor: "bob"}
+			r, err := reader.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 100)
+			for off := 0; off < 1000; off = off + 100 {
+				n, err := r.ReadAt(buf, int64(off))
+				So(err, ShouldEqual, nil)
+				So(n, ShouldEqual, 100)
+			}
+			So(r.Close(), ShouldEqual, nil)
+			_, err = primitive.WriteAt([]byte("cut"), 0)
+			So(err, ShouldEqual, nil)
+			So(primitive.Append(bufio.NewReader(bytes.NewReader([]byte("end"))), 3), ShouldEqual, nil)
+			So(primitive.Truncate(1000), ShouldEqual, nil)
+			clone, err := primitive.Clone()
+			So(err, ShouldEqual, nil)
+			composed := mode.Primitive{Name: "both.mov", Actor: "alice"}
+			So(composed.Compose([]string{primitive.Id, clone.Id}), ShouldEqual, nil)
+			So(ops(primitive.Id, start), ShouldResemble, []string{"make", "open", "read", "write", "append", "truncate", "clone"})
+			So(ops(composed.Id, start), ShouldResemble, []string{"compose"})
+
+			records, err := mode.ReadAuditOf(primitive.Id, start, time.Now().Add(time.Second), 1000)
+			So(err, ShouldEqual, nil)
+			So(records[2].Actor, ShouldEqual, "bob")
+			So(records[2].Bytes, ShouldEqual, 1000)
+			So(records[3].Bytes, ShouldEqual, 3)
+			So(records[5].Bytes, ShouldEqual, 1000)
+			So(clone.Destroy(), ShouldEqual, nil)
+			So(composed.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Reading to the end is one record", func() {
+			r, err := primitive.Open()
+			So(err, ShouldEqual, nil)
+			got, err := ioutil.ReadAll(r)
+			So(err, ShouldEqual, nil)
+			So(len(got), ShouldEqual, len(data))
+			So(r.Close(), ShouldEqual, nil)
+			So(ops(primitive.Id, start), ShouldResemble, []string{"make", "open", "read"})
+			records, err := mode.ReadAuditOf(primitive.Id, start, time.Now().Add(time.Second), 1000)
+			So(err, ShouldEqual, nil)
+			So(records[2].Bytes, ShouldEqual, len(data))
+		})
+		Convey("Finished uploads and DestroyMeta are recorded", func() {
+			session, err := (&mode.Primitive{Name: "take-2.mov", Length: 5, Actor: "alice"}).StartSession()
+			So(err, ShouldEqual, nil)
+			So(session.Write(bufio.NewReader(bytes.NewReader(data[:5])), 0, 5), ShouldEqual, nil)
+			finalized, err := session.Finalize()
+			So(err, ShouldEqual, nil)
+			upload, err := (&mode.Primitive{Name: "take-3.mov", Actor: "alice"}).StartMultipart()
+			So(err, ShouldEqual, nil)
+			_, err = upload.UploadPart(1, bufio.NewReader(bytes.NewReader(data[:7])), 7)
+			So(err, ShouldEqual, nil)
+			completed, err := upload.Complete([]int{1})
+			So(err, ShouldEqual, nil)
+			So(finalized.DestroyMeta(), ShouldEqual, nil)
+			So(completed.Destroy(), ShouldEqual, nil)
+			So(ops(finalized.Id, start), ShouldResemble, []string{"make", "destroy"})
+			So(ops(completed.Id, start), ShouldResemble, []string{"make", "destroy"})
+			records, err := mode.ReadAuditOf(completed.Id, start, time.Now().Add(time.Second), 1000)
+			So(err, ShouldEqual, nil)
+			So(records[0].Actor, ShouldEqual, "alice")
+			So(records[0].Bytes, ShouldEqual, 7)
+		})
+		Convey("Failures are recorded", func() {
+			So(primitive.Destroy(), ShouldEqual, nil)
+			reader := mode.Primitive{Id: primitive.Id, Actor: "mallory"}
+			So(reader.Stream(bufio.NewWriter(&bytes.Buffer{})), ShouldEqual, mode.NOT_FOUND)
+			records, err := mode.ReadAuditOf(primitive.Id, start, time.Now().Add(time.Second), 1000)
+			So(err, ShouldEqual, nil)
+			So(len(records), ShouldEqual, 3)
+			So(records[2].Op, ShouldEqual, "stream")
+			So(records[2].Actor, ShouldEqual, "mallory")
+			So(records[2].Result, ShouldEqual, mode.NOT_FOUND.Error())
+		})
+		Convey("The log is read by time", func() {
+			middle := time.Now()
+			So(primitive.Destroy(), ShouldEqual, nil)
+			records, err := mode.ReadAudit(middle, time.Now().Add(time.Second), 1000)
+			So(err, ShouldEqual, nil)
+			So(len(records), ShouldEqual, 1)
+			So(records[0].Op, ShouldEqual, "destroy")
+			So(records[0].Id, ShouldEqual, primitive.Id)
+			records, err = mode.ReadAudit(start, middle, 1000)
+			So(err, ShouldEqual, nil)
+			So(len(records), ShouldEqual, 1)
+			So(records[0].Op, ShouldEqual, "make")
+		})
+		Convey("The log is paged through without missing a record", func() {
+			So(primitive.SetMeta(), ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, nil)
+			for _, id := range []string{primitive.Id, ""} {
+				var records []mode.AuditRecord
+				var err error
+				if id == "" {
+					records, err = mode.ReadAudit(start, time.Now().Add(time.Second), 1)
+				} else {
+					records, err = mode.ReadAuditOf(id, start, time.Now().Add(time.Second), 1)
+				}
+				found := []string{}
+				for len(records) == 1 {
+					So(err, ShouldEqual, nil)
+					found = append(found, records[0].Op)
+					records, err = mode.ReadAuditAfter(id, records[0].Seq, time.Now().Add(time.Second), 1)
+				}
+				So(err, ShouldEqual, nil)
+				So(found, ShouldResemble, []string{"make", "setmeta", "destroy"})
+			}
+		})
+		Convey("Sweeps are recorded with no actor", func() {
+			primitive.Expires = time.Now().Add(-time.Minute).Format(time.RFC3339)
+			So(primitive.SetMeta(), ShouldEqual, nil)
+			n, err := mode.SweepExpired()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			records, err := mode.ReadAuditOf(primitive.Id, start, time.Now().Add(time.Second), 1000)
+			So(err, ShouldEqual, nil)
+			So(len(records), ShouldEqual, 3)
+			So(records[2].Op, ShouldEqual, "expire")
+			So(records[2].Actor, ShouldEqual, "")
+			So(records[2].Bytes, ShouldEqual, len(data))
+		})
+		Convey("Nothing is recorded unless asked for", func() {
+			So(mode.SetOptions(mode.Options{}), ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, nil)
+			So(ops(primitive.Id, start), ShouldResemble, []string{"make"})
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			primitive.Destroy()
+			for _, prefix := range []string{"primitive:audit:", "primitive:auditid:"} {
+				delReq := &proto.DeleteRangeRequest{}
+				delReq.Key = proto.Key(prefix)
+				delReq.EndKey = delReq.Key.PrefixEnd()
+				kv.Call(proto.DeleteRange, delReq, &proto.DeleteRangeResponse{})
+			}
+		})
+	})
+}
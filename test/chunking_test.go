@@ -0,0 +1,112 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"math/rand"
+	"testing"
+)
+
+func TestChunking(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing content defined chunking", t, func() {
+		chunking := &mode.Chunking{Min: 2048, Avg: 8192, Max: 32768}
+		So(mode.SetOptions(mode.Options{Dedup: true, Chunking: chunking}), ShouldEqual, nil)
+		data := make([]byte, 300000)
+		rand.New(rand.NewSource(36)).Read(data)
+		primitive := mode.Primitive{Name: "draft-1.doc", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		edited := append(append(append([]byte{}, data[:150000]...), 'x'), data[150000:]...)
+		revision := mode.Primitive{Name: "draft-2.doc", Length: len(edited)}
+		So(revision.Make(bufio.NewReader(bytes.NewReader(edited))), ShouldEqual, nil)
+
+		Convey("Chunk sizes vary within the bounds and are recorded", func() {
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			So(readPrimitive.Find(), ShouldEqual, nil)
+			So(readPrimitive.Chunking, ShouldResemble, chunking)
+			So(len(readPrimitive.Sizes), ShouldEqual, readPrimitive.Chunks)
+			var total int
+			for i, size := range readPrimitive.Sizes {
+				if i < len(readPrimitive.Sizes)-1 {
+					So(size, ShouldBeGreaterThan, chunking.Min)
+				}
+				So(size, ShouldBeLessThanOrEqualTo, chunking.Max)
+				total = total + size
+			}
+			So(total, ShouldEqual, len(data))
+		})
+		Convey("An inserted byte only changes the chunks around it", func() {
+			a, b := mode.Primitive{Id: primitive.Id}, mode.Primitive{Id: revision.Id}
+			So(a.Find(), ShouldEqual, nil)
+			So(b.Find(), ShouldEqual, nil)
+			shared := make(map[string]bool)
+			for _, ref := range a.Refs {
+				shared[ref] = true
+			}
+			var changed int
+			for _, ref := range b.Refs {
+				if !shared[ref] {
+					changed = changed + 1
+				}
+			}
+			So(changed, ShouldBeLessThanOrEqualTo, 2)
+		})
+		Convey("Random access reads across variable chunks", func() {
+			reader, err := revision.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 5000)
+			_, err = reader.ReadAt(buf, 148000)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(buf, edited[148000:153000]), ShouldBeTrue)
+		})
+		Convey("Appending gives the chunks of writing everything at once", func() {
+			part := mode.Primitive{Name: "draft-1.doc", Length: 100000}
+			So(part.Make(bufio.NewReader(bytes.NewReader(data[:100000]))), ShouldEqual, nil)
+			So(part.Append(bufio.NewReader(bytes.NewReader(data[100000:])), len(data)-100000), ShouldEqual, nil)
+			a, b := mode.Primitive{Id: primitive.Id}, mode.Primitive{Id: part.Id}
+			So(a.Find(), ShouldEqual, nil)
+			So(b.Find(), ShouldEqual, nil)
+			So(b.Refs, ShouldResemble, a.Refs)
+			So(b.Md5, ShouldEqual, a.Md5)
+			So(part.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Chunk sizes must be ordered", func() {
+			So(mode.SetOptions(mode.Options{Chunking: &mode.Chunking{Min: 8192, Avg: 4096, Max: 32768}}), ShouldNotEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			primitive.Destroy()
+			revision.Destroy()
+		})
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// stream reads the whole primitive with the given id
+func stream(id string) ([]byte, error) {
+	var out bytes.Buffer
+	writer := bufio.NewWriter(&out)
+	readPrimitive := mode.Primitive{Id: id}
+	err := readPrimitive.Stream(writer)
+	writer.Flush()
+	return out.Bytes(), err
+}
+
+func TestClone(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing Primitive.Clone", t, func() {
+		original := bytes.Repeat([]byte("template"), mode.CHUNK_SIZE/3)
+		primitive := mode.Primitive{Name: "base.html", Length: len(original)}
+		err := primitive.Make(bufio.NewReader(bytes.NewReader(original)))
+		So(err, ShouldEqual, nil)
+
+		clone, err := primitive.Clone()
+		So(err, ShouldEqual, nil)
+		So(clone.Id, ShouldNotEqual, primitive.Id)
+		So(clone.Length, ShouldEqual, primitive.Length)
+		So(clone.Md5, ShouldEqual, primitive.Md5)
+
+		Convey("The clone has the same contents", func() {
+			got, err := stream(clone.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, original), ShouldBeTrue)
+		})
+		Convey("Destroying the original leaves the clone intact", func() {
+			So(primitive.Destroy(), ShouldEqual, nil)
+			got, err := stream(clone.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, original), ShouldBeTrue)
+		})
+		Convey("Writing to the clone leaves the original intact", func() {
+			_, err := clone.WriteAt([]byte("per-user"), 10)
+			So(err, ShouldEqual, nil)
+			So(clone.Append(bufio.NewReader(bytes.NewReader([]byte("more"))), 4), ShouldEqual, nil)
+
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, original), ShouldBeTrue)
+
+			got, err = stream(clone.Id)
+			So(err, ShouldEqual, nil)
+			So(string(got[10:18]), ShouldEqual, "per-user")
+			So(string(got[len(got)-4:]), ShouldEqual, "more")
+		})
+		Reset(func() {
+			primitive.Destroy()
+			clone.Destroy()
+		})
+	})
+	Convey("Testing a clone of a held, expiring primitive", t, func() {
+		kv := rawClient()
+		original := bytes.Repeat([]byte("evidence"), 1000)
+		primitive := mode.Primitive{Name: "exhibit-a.txt", Length: len(original), Owner: "alice",
+			Created: "2015-01-02T03:04:05Z", ACL: []mode.Grant{{Principal: "bob", Read: true}}}
+		primitive.ExpireIn(time.Hour)
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(original))), ShouldEqual, nil)
+		So(primitive.Lock(time.Now().Add(24*time.Hour)), ShouldEqual, nil)
+		So(primitive.PlaceHold(), ShouldEqual, nil)
+
+		copier := mode.Primitive{Id: primitive.Id, Actor: "bob"}
+		clone, err := copier.Clone()
+		So(err, ShouldEqual, nil)
+		found := mode.Primitive{Id: clone.Id}
+		So(found.Find(), ShouldEqual, nil)
+		So(found.Owner, ShouldEqual, "bob")
+		So(found.Hold, ShouldBeFalse)
+		So(found.Retain, ShouldEqual, "")
+		So(found.Expires, ShouldEqual, "")
+		So(len(found.ACL), ShouldEqual, 0)
+		So(found.Created, ShouldNotEqual, primitive.Created)
+		So(found.Name, ShouldEqual, primitive.Name)
+		So(found.Destroy(), ShouldEqual, nil)
+
+		Reset(func() {
+			mode.SetCustodian("", "records-office")
+			(&mode.Primitive{Id: primitive.Id}).Release("records-office")
+			(&mode.Primitive{Id: primitive.Id}).Destroy()
+			delReq := &proto.DeleteRequest{}
+			delReq.Key = proto.Key("primitive:custodian")
+			kv.Call(proto.Delete, delReq, &proto.DeleteResponse{})
+		})
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing Primitive.Compose", t, func() {
+		var segments []mode.Primitive
+		var ids []string
+		var expected []byte
+		for i, size := range []int{mode.CHUNK_SIZE + 11, 300, 2*mode.CHUNK_SIZE - 7} {
+			data := bytes.Repeat([]byte{byte('a' + i)}, size)
+			segment := mode.Primitive{Name: "segment.ts", Length: size}
+			err := segment.Make(bufio.NewReader(bytes.NewReader(data)))
+			So(err, ShouldEqual, nil)
+			segments = append(segments, segment)
+			ids = append(ids, segment.Id)
+			expected = append(expected, data...)
+		}
+
+		composed := mode.Primitive{Name: "movie.ts", MimeType: "video/mp2t"}
+		err := composed.Compose(ids)
+		So(err, ShouldEqual, nil)
+		So(composed.Length, ShouldEqual, len(expected))
+		So(composed.Name, ShouldEqual, "movie.ts")
+		sum := md5.Sum(expected)
+		So(composed.Md5, ShouldEqual, hex.EncodeToString(sum[:]))
+
+		Convey("The composed primitive streams the segments in order", func() {
+			got, err := stream(composed.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, expected), ShouldBeTrue)
+		})
+		Convey("Random access works across segment boundaries", func() {
+			reader, err := composed.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 400)
+			off := mode.CHUNK_SIZE
+			n, err := reader.ReadAt(buf, int64(off))
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, len(buf))
+			So(bytes.Equal(buf, expected[off:off+len(buf)]), ShouldBeTrue)
+		})
+		Convey("The composed primitive outlives its sources", func() {
+			for i := range segments {
+				So(segments[i].Destroy(), ShouldEqual, nil)
+			}
+			got, err := stream(composed.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, expected), ShouldBeTrue)
+		})
+		Convey("The composed primitive can be written and truncated", func() {
+			off := mode.CHUNK_SIZE + 5
+			_, err := composed.WriteAt([]byte("0123456789"), int64(off))
+			So(err, ShouldEqual, nil)
+			copy(expected[off:], []byte("0123456789"))
+			So(composed.Truncate(int64(off+300)), ShouldEqual, nil)
+			So(composed.Append(bufio.NewReader(bytes.NewReader([]byte("end"))), 3), ShouldEqual, nil)
+			expected = append(expected[:off+300], []byte("end")...)
+
+			got, err := stream(composed.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, expected), ShouldBeTrue)
+
+			got, err = stream(segments[1].Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, bytes.Repeat([]byte("b"), 300)), ShouldBeTrue)
+		})
+		Convey("Composing a primitive that does not exist fails", func() {
+			missing := mode.Primitive{Name: "missing.ts"}
+			err := missing.Compose([]string{ids[0], "e64a919ef57c4481bcd5fba43f8efb9d"})
+			So(err, ShouldEqual, mode.NOT_FOUND)
+		})
+		Reset(func() {
+			for i := range segments {
+				segments[i].Destroy()
+			}
+			composed.Destroy()
+		})
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing compressed primitives", t, func() {
+		So(mode.SetOptions(mode.Options{Compression: "gzip"}), ShouldEqual, nil)
+		text := bytes.Repeat([]byte("id,name,value\n1,one,1.0\n"), mode.CHUNK_SIZE/10)
+		noise := make([]byte, mode.CHUNK_SIZE+10)
+		rand.Read(noise)
+
+		csv := mode.Primitive{Name: "data.csv", Length: len(text)}
+		So(csv.Make(bufio.NewReader(bytes.NewReader(text))), ShouldEqual, nil)
+		random := mode.Primitive{Name: "random.bin", Length: len(noise)}
+		So(random.Make(bufio.NewReader(bytes.NewReader(noise))), ShouldEqual, nil)
+		So(mode.SetOptions(mode.Options{}), ShouldEqual, nil)
+
+		Convey("The codec is recorded and Length is the uncompressed size", func() {
+			readPrimitive := mode.Primitive{Id: csv.Id}
+			So(readPrimitive.Find(), ShouldEqual, nil)
+			So(readPrimitive.Codec, ShouldEqual, "gzip")
+			So(readPrimitive.Length, ShouldEqual, len(text))
+		})
+		Convey("Compressible and incompressible primitives stream back unchanged", func() {
+			got, err := stream(csv.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, text), ShouldBeTrue)
+			got, err = stream(random.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, noise), ShouldBeTrue)
+		})
+		Convey("Writes to a compressed primitive are compressed too", func() {
+			_, err := csv.WriteAt([]byte("2,two,2.0\n"), int64(len(text)))
+			So(err, ShouldEqual, nil)
+			reader, err := csv.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 10)
+			_, err = reader.ReadAt(buf, int64(len(text)))
+			So(err, ShouldEqual, nil)
+			So(string(buf), ShouldEqual, "2,two,2.0\n")
+		})
+		Convey("Composing compressed and uncompressed primitives", func() {
+			plain := mode.Primitive{Name: "plain.txt", Length: 5}
+			So(plain.Make(bufio.NewReader(bytes.NewReader([]byte("plain")))), ShouldEqual, nil)
+			composed := mode.Primitive{Name: "all.bin"}
+			So(composed.Compose([]string{csv.Id, plain.Id, random.Id}), ShouldEqual, nil)
+			So(composed.Codec, ShouldEqual, "gzip")
+
+			got, err := stream(composed.Id)
+			So(err, ShouldEqual, nil)
+			expected := append(append(append([]byte{}, text...), []byte("plain")...), noise...)
+			So(bytes.Equal(got, expected), ShouldBeTrue)
+			So(plain.Destroy(), ShouldEqual, nil)
+			So(composed.Destroy(), ShouldEqual, nil)
+		})
+		Convey("An unknown codec is refused", func() {
+			So(mode.SetOptions(mode.Options{Compression: "lz4"}), ShouldNotEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			csv.Destroy()
+			random.Destroy()
+		})
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing encrypted primitives", t, func() {
+		keys := &mode.MasterKeys{Current: "2015", Keys: map[string][]byte{"2015": bytes.Repeat([]byte{7}, 32)}}
+		So(mode.SetOptions(mode.Options{Keys: keys, Compression: "flate"}), ShouldEqual, nil)
+		data := bytes.Repeat([]byte("customer record\n"), mode.CHUNK_SIZE/8)
+		primitive := mode.Primitive{Name: "records.txt", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("The wrapped data key and scheme are recorded in the meta data", func() {
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			So(readPrimitive.Find(), ShouldEqual, nil)
+			So(readPrimitive.Cipher, ShouldEqual, mode.CIPHER)
+			So(readPrimitive.KeyId, ShouldEqual, "2015")
+			So(len(readPrimitive.DataKey), ShouldBeGreaterThan, 32)
+		})
+		Convey("Stream and ranged reads decrypt", func() {
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+
+			reader, err := primitive.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 32)
+			_, err = reader.ReadAt(buf, int64(mode.CHUNK_SIZE-16))
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(buf, data[mode.CHUNK_SIZE-16:mode.CHUNK_SIZE+16]), ShouldBeTrue)
+		})
+		Convey("Writes, appends and clones of an encrypted primitive", func() {
+			_, err := primitive.WriteAt([]byte("CUSTOMER"), 0)
+			So(err, ShouldEqual, nil)
+			So(primitive.Append(bufio.NewReader(bytes.NewReader([]byte("last\n"))), 5), ShouldEqual, nil)
+			clone, err := primitive.Clone()
+			So(err, ShouldEqual, nil)
+
+			got, err := stream(clone.Id)
+			So(err, ShouldEqual, nil)
+			expected := append(append([]byte("CUSTOMER"), data[8:]...), []byte("last\n")...)
+			So(bytes.Equal(got, expected), ShouldBeTrue)
+			So(clone.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Composing encrypted primitives with different data keys", func() {
+			other := mode.Primitive{Name: "more.txt", Length: 4}
+			So(other.Make(bufio.NewReader(bytes.NewReader([]byte("more")))), ShouldEqual, nil)
+			composed := mode.Primitive{Name: "all.txt"}
+			So(composed.Compose([]string{primitive.Id, other.Id}), ShouldEqual, nil)
+			So(other.Destroy(), ShouldEqual, nil)
+
+			got, err := stream(composed.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, append(append([]byte{}, data...), []byte("more")...)), ShouldBeTrue)
+			So(composed.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Without the master key the primitive can't be read", func() {
+			So(mode.SetOptions(mode.Options{}), ShouldEqual, nil)
+			_, err := stream(primitive.Id)
+			So(err, ShouldNotEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{Keys: keys})
+			primitive.Destroy()
+			mode.SetOptions(mode.Options{})
+		})
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing deduplicated primitives", t, func() {
+		So(mode.SetOptions(mode.Options{Dedup: true}), ShouldEqual, nil)
+		data := append(bytes.Repeat([]byte{'a'}, mode.CHUNK_SIZE), bytes.Repeat([]byte{'b'}, 1000)...)
+		first := mode.Primitive{Name: "attachment.bin", Length: len(data)}
+		So(first.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+		second := mode.Primitive{Name: "attachment copy.bin", Length: len(data)}
+		So(second.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("Identical uploads refer to the same chunks", func() {
+			a, b := mode.Primitive{Id: first.Id}, mode.Primitive{Id: second.Id}
+			So(a.Find(), ShouldEqual, nil)
+			So(b.Find(), ShouldEqual, nil)
+			So(a.Dedup, ShouldBeTrue)
+			So(len(a.Refs), ShouldEqual, 2)
+			So(a.Refs, ShouldResemble, b.Refs)
+		})
+		Convey("Each copy outlives the other", func() {
+			So(first.Destroy(), ShouldEqual, nil)
+			got, err := stream(second.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+		})
+		Convey("Writing to one copy leaves the other as it was", func() {
+			_, err := first.WriteAt([]byte("bb"), 0)
+			So(err, ShouldEqual, nil)
+			got, err := stream(second.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			got, err = stream(first.Id)
+			So(err, ShouldEqual, nil)
+			So(string(got[:3]), ShouldEqual, "bba")
+		})
+		Convey("Deduplication can't be combined with encryption", func() {
+			keys := &mode.MasterKeys{Current: "k", Keys: map[string][]byte{"k": make([]byte, 32)}}
+			So(mode.SetOptions(mode.Options{Dedup: true, Keys: keys}), ShouldNotEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			first.Destroy()
+			second.Destroy()
+		})
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestDigest(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing the digest index", t, func() {
+		data := bytes.Repeat([]byte("quarterly report\n"), 20000)
+		sum := sha256.Sum256(data)
+		digest := hex.EncodeToString(sum[:])
+		primitive := mode.Primitive{Name: "report.txt", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+		So(primitive.Sha256, ShouldEqual, digest)
+
+		Convey("A stored file can be found by sha256 and length", func() {
+			found, err := mode.FindDigest(digest, len(data))
+			So(err, ShouldEqual, nil)
+			So(found, ShouldEqual, primitive.Id)
+			_, err = mode.FindDigest(digest, len(data)-1)
+			So(err, ShouldEqual, mode.NOT_FOUND)
+		})
+		Convey("The index follows changes to the file", func() {
+			So(primitive.Append(bufio.NewReader(bytes.NewReader([]byte("appendix\n"))), 9), ShouldEqual, nil)
+			_, err := mode.FindDigest(digest, len(data))
+			So(err, ShouldEqual, mode.NOT_FOUND)
+			sum := sha256.Sum256(append(append([]byte{}, data...), []byte("appendix\n")...))
+			found, err := mode.FindDigest(hex.EncodeToString(sum[:]), len(data)+9)
+			So(err, ShouldEqual, nil)
+			So(found, ShouldEqual, primitive.Id)
+
+			So(primitive.Destroy(), ShouldEqual, nil)
+			_, err = mode.FindDigest(hex.EncodeToString(sum[:]), len(data)+9)
+			So(err, ShouldEqual, mode.NOT_FOUND)
+		})
+		Convey("With file dedup on, uploading the same file again makes a clone", func() {
+			So(mode.SetOptions(mode.Options{DedupFiles: true}), ShouldEqual, nil)
+			again := mode.Primitive{Name: "report copy.txt", Length: len(data)}
+			So(again.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			So(again.Id, ShouldNotEqual, primitive.Id)
+			So(again.Name, ShouldEqual, "report copy.txt")
+
+			// the chunks are those written by the original
+			So(again.Chunks, ShouldEqual, 2)
+			So(again.Refs[0], ShouldStartWith, primitive.Id)
+
+			So(primitive.Destroy(), ShouldEqual, nil)
+			got, err := stream(again.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			So(again.Destroy(), ShouldEqual, nil)
+		})
+		Convey("A clone made by file dedup keeps its uploader's owner, access and expiry", func() {
+			So(mode.SetOptions(mode.Options{DedupFiles: true}), ShouldEqual, nil)
+			first := mode.Primitive{Name: "alice.txt", Length: len(data), Actor: "alice",
+				ACL: []mode.Grant{{Principal: "bob", Read: true}}}
+			first.ExpireIn(time.Hour)
+			So(first.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			second := mode.Primitive{Name: "carol.txt", Length: len(data), Actor: "carol",
+				ACL: []mode.Grant{{Principal: "dave", Read: true, Write: true}}}
+			So(second.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			So(second.Refs[0], ShouldStartWith, primitive.Id)
+
+			for _, p := range []mode.Primitive{first, second} {
+				found := mode.Primitive{Id: p.Id}
+				So(found.Find(), ShouldEqual, nil)
+				So(found.Owner, ShouldEqual, p.Actor)
+				So(found.ACL, ShouldResemble, p.ACL)
+				So(found.Expires, ShouldEqual, p.Expires)
+				So(found.Name, ShouldEqual, p.Name)
+			}
+			So(second.Expires, ShouldEqual, "")
+			_, err := (&mode.Primitive{Id: second.Id, Actor: "bob"}).Open()
+			So(err, ShouldEqual, mode.FORBIDDEN)
+			_, err = (&mode.Primitive{Id: second.Id, Actor: "dave"}).Open()
+			So(err, ShouldEqual, nil)
+			So(first.Destroy(), ShouldEqual, nil)
+			So(second.Destroy(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			primitive.Destroy()
+		})
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/cockroachdb/cockroach/client"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"math/rand"
+	"net/http"
+	"testing"
+)
+
+// rawClient returns a client of its own, for damaging chunks behind the
+// back of the library
+func rawClient() *client.KV {
+	sender := client.NewHTTPSender("192.168.0.2:8080", &http.Transport{
+		TLSClientConfig: rpc.LoadInsecureTLSConfig().Config(),
+	})
+	kv := client.NewKV(sender, nil)
+	kv.User = storage.UserRoot
+	return kv
+}
+
+func chunkKey(id string, n int) proto.Key {
+	return proto.Key(fmt.Sprintf("primitive:%s:%10d", id, n))
+}
+
+func TestErasure(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	kv := rawClient()
+	lose := func(id string, n int) {
+		delReq := &proto.DeleteRequest{}
+		delReq.Key = chunkKey(id, n)
+		So(kv.Call(proto.Delete, delReq, &proto.DeleteResponse{}), ShouldEqual, nil)
+	}
+	damage := func(id string, n int) {
+		So(kv.Call(proto.Put, proto.PutArgs(chunkKey(id, n), []byte("bit rot")), &proto.PutResponse{}), ShouldEqual, nil)
+	}
+	Convey("Testing erasure coded primitives", t, func() {
+		So(mode.SetOptions(mode.Options{Erasure: &mode.Erasure{Data: 3, Parity: 2}}), ShouldEqual, nil)
+		data := make([]byte, mode.CHUNK_SIZE*6+mode.CHUNK_SIZE/2)
+		rand.New(rand.NewSource(40)).Read(data)
+		primitive := mode.Primitive{Name: "scan-1915.tiff", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+		So(len(primitive.Stripes), ShouldEqual, 3)
+
+		Convey("Stream rebuilds lost and damaged chunks on the fly", func() {
+			lose(primitive.Id, 1)
+			damage(primitive.Id, 2)
+			lose(primitive.Id, 6)
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+
+			reader, err := primitive.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 100)
+			_, err = reader.ReadAt(buf, int64(mode.CHUNK_SIZE*2+10))
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(buf, data[mode.CHUNK_SIZE*2+10:mode.CHUNK_SIZE*2+110]), ShouldBeTrue)
+		})
+		Convey("Repair writes the lost chunks back", func() {
+			lose(primitive.Id, 0)
+			damage(primitive.Id, 4)
+			n, err := primitive.Repair()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 2)
+			getResp := &proto.GetResponse{}
+			So(kv.Call(proto.Get, proto.GetArgs(chunkKey(primitive.Id, 0)), getResp), ShouldEqual, nil)
+			So(bytes.Equal(getResp.Value.Bytes, data[:mode.CHUNK_SIZE]), ShouldBeTrue)
+
+			n, err = mode.RepairAll()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+		})
+		Convey("More losses in a stripe than it has parity can't be rebuilt", func() {
+			lose(primitive.Id, 0)
+			lose(primitive.Id, 1)
+			lose(primitive.Id, 2)
+			_, err := stream(primitive.Id)
+			So(err, ShouldNotEqual, nil)
+			_, err = primitive.Repair()
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("Parity follows writes", func() {
+			_, err := primitive.WriteAt([]byte("restored"), int64(mode.CHUNK_SIZE*3))
+			So(err, ShouldEqual, nil)
+			copy(data[mode.CHUNK_SIZE*3:], []byte("restored"))
+			So(primitive.Truncate(int64(mode.CHUNK_SIZE*4)), ShouldEqual, nil)
+			So(len(primitive.Stripes), ShouldEqual, 2)
+			// the written chunk is copied on write under a new key
+			writtenKey := proto.Key("primitive:" + primitive.Refs[3])
+			delReq := &proto.DeleteRequest{}
+			delReq.Key = writtenKey
+			So(kv.Call(proto.Delete, delReq, &proto.DeleteResponse{}), ShouldEqual, nil)
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data[:mode.CHUNK_SIZE*4]), ShouldBeTrue)
+		})
+		Convey("Clones share the parity", func() {
+			clone, err := primitive.Clone()
+			So(err, ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, nil)
+			lose(primitive.Id, 5)
+			got, err := stream(clone.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			So(clone.Destroy(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			primitive.Destroy()
+		})
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	kv := rawClient()
+	// kinds returns the kinds of the events about id after the one
+	// numbered after
+	kinds := func(after int64, id string) []string {
+		events, err := mode.ReadEvents(after, 1000)
+		So(err, ShouldEqual, nil)
+		found := []string{}
+		for _, e := range events {
+			if e.Id == id {
+				found = append(found, e.Type)
+			}
+		}
+		return found
+	}
+	last := func() int64 {
+		events, err := mode.ReadEvents(0, 1000)
+		So(err, ShouldEqual, nil)
+		if len(events) == 0 {
+			return 0
+		}
+		return events[len(events)-1].Seq
+	}
+	Convey("Testing the event feed", t, func() {
+		So(mode.SetOptions(mode.Options{Events: true}), ShouldEqual, nil)
+		start := last()
+		data := bytes.Repeat([]byte("frame "), 50000)
+		primitive := mode.Primitive{Name: "clip.mov", MimeType: "video/quicktime", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("Changes are recorded in order", func() {
+			_, err := primitive.WriteAt([]byte("title card"), 0)
+			So(err, ShouldEqual, nil)
+			primitive.Name = "clip-final.mov"
+			So(primitive.SetMeta(), ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, nil)
+			So(kinds(start, primitive.Id), ShouldResemble, []string{"create", "update", "update", "delete"})
+
+			events, err := mode.ReadEvents(start, 1000)
+			So(err, ShouldEqual, nil)
+			So(events[0].Name, ShouldEqual, "clip.mov")
+			So(events[0].Length, ShouldEqual, len(data))
+			for i := 1; i < len(events); i++ {
+				So(events[i].Seq, ShouldBeGreaterThan, events[i-1].Seq)
+			}
+		})
+		Convey("Moving chunks records nothing", func() {
+			So(primitive.Recompress("gzip"), ShouldEqual, nil)
+			So(kinds(start, primitive.Id), ShouldResemble, []string{"create"})
+		})
+		Convey("The trash deletes and restores", func() {
+			So(primitive.Trash(), ShouldEqual, nil)
+			So(primitive.Restore(), ShouldEqual, nil)
+			So(kinds(start, primitive.Id), ShouldResemble, []string{"create", "delete", "create"})
+		})
+		Convey("Expiry is recorded once, when swept", func() {
+			primitive.Expires = time.Now().Add(-time.Minute).Format(time.RFC3339)
+			So(primitive.SetMeta(), ShouldEqual, nil)
+			n, err := mode.SweepExpired()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			So(kinds(start, primitive.Id), ShouldResemble, []string{"create", "expire"})
+		})
+		Convey("A subscription delivers new events", func() {
+			sub := mode.Subscribe(start, 10*time.Millisecond)
+			e := <-sub.C
+			So(e.Type, ShouldEqual, "create")
+			So(e.Id, ShouldEqual, primitive.Id)
+			clone, err := primitive.Clone()
+			So(err, ShouldEqual, nil)
+			select {
+			case e = <-sub.C:
+				So(e.Type, ShouldEqual, "create")
+				So(e.Id, ShouldEqual, clone.Id)
+			case <-time.After(time.Second):
+				So("no event", ShouldEqual, "an event")
+			}
+			sub.Close()
+			So(sub.Err(), ShouldEqual, nil)
+			_, open := <-sub.C
+			So(open, ShouldBeFalse)
+			// closing again is harmless
+			sub.Close()
+			So(clone.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Nothing is recorded unless asked for", func() {
+			So(mode.SetOptions(mode.Options{}), ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, nil)
+			So(kinds(start, primitive.Id), ShouldResemble, []string{"create"})
+		})
+		Reset(func() {
+			primitive.Destroy()
+			mode.SetOptions(mode.Options{})
+			So(mode.TrimEvents(last()), ShouldEqual, nil)
+			delReq := &proto.DeleteRequest{}
+			delReq.Key = proto.Key("primitive:eventSeq")
+			kv.Call(proto.Delete, delReq, &proto.DeleteResponse{})
+		})
+	})
+}
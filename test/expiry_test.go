@@ -0,0 +1,99 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing expiring primitives", t, func() {
+		data := bytes.Repeat([]byte("export "), 40000)
+		export := mode.Primitive{Name: "export.csv", Length: len(data)}
+		export.ExpireIn(time.Hour)
+		So(export.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+		kept := mode.Primitive{Name: "report.csv", Length: len(data)}
+		So(kept.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("A primitive is found until it expires", func() {
+			So(export.Expires, ShouldNotEqual, "")
+			got, err := stream(export.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			n, err := mode.SweepExpired()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+		})
+		Convey("An expired primitive is not found before it is swept", func() {
+			export.Expires = time.Now().Add(-time.Minute).Format(time.RFC3339)
+			So(export.SetMeta(), ShouldEqual, nil)
+			_, err := stream(export.Id)
+			So(err, ShouldEqual, mode.NOT_FOUND)
+			So((&mode.Primitive{Id: export.Id}).Meta(), ShouldEqual, mode.NOT_FOUND)
+			_, err = (&mode.Primitive{Id: export.Id}).Clone()
+			So(err, ShouldEqual, mode.NOT_FOUND)
+
+			n, err := mode.SweepExpired()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			So(kept.Find(), ShouldEqual, nil)
+		})
+		Convey("Clearing the expiry keeps the primitive", func() {
+			export.Expires = time.Now().Add(-time.Minute).Format(time.RFC3339)
+			So(export.SetMeta(), ShouldEqual, nil)
+			export.Expires = ""
+			So(export.SetMeta(), ShouldEqual, nil)
+			n, err := mode.SweepExpired()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+			So(export.Find(), ShouldEqual, nil)
+		})
+		Convey("Sessions carry the expiry to the primitive", func() {
+			upload := mode.Primitive{Name: "bundle.zip", Expires: "2001-01-01T00:00:00+01:00"}
+			s, err := upload.StartSession()
+			So(err, ShouldEqual, nil)
+			So(s.Primitive.Expires, ShouldEqual, "2000-12-31T23:00:00Z")
+			So(s.Abort(), ShouldEqual, nil)
+		})
+		Convey("A malformed expiry is rejected", func() {
+			bad := mode.Primitive{Name: "bad.csv", Length: len(data), Expires: "tomorrow"}
+			So(bad.Make(bufio.NewReader(bytes.NewReader(data))), ShouldNotEqual, nil)
+		})
+		Reset(func() {
+			export.Destroy()
+			kept.Destroy()
+			mode.SweepExpired()
+		})
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestInline(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing primitives stored inline", t, func() {
+		So(mode.SetOptions(mode.Options{Inline: 1024}), ShouldEqual, nil)
+		data := []byte(`{"icon": "star", "size": 16}`)
+		primitive := mode.Primitive{Name: "icon.json", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("The contents are in the meta data", func() {
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			So(readPrimitive.Find(), ShouldEqual, nil)
+			So(len(readPrimitive.Data), ShouldBeGreaterThan, 0)
+			So(readPrimitive.Chunks, ShouldEqual, 1)
+		})
+		Convey("Stream and ranged reads serve inline contents", func() {
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(string(got), ShouldEqual, string(data))
+
+			reader, err := primitive.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 4)
+			_, err = reader.ReadAt(buf, 10)
+			So(err, ShouldEqual, nil)
+			So(string(buf), ShouldEqual, "star")
+		})
+		Convey("A negative length is refused", func() {
+			negative := mode.Primitive{Name: "icon.json", Length: -1}
+			So(negative.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, mode.MISSING_ARG)
+		})
+		Convey("Files over the threshold are chunked as before", func() {
+			big := mode.Primitive{Name: "big.json", Length: 1025}
+			So(big.Make(bufio.NewReader(bytes.NewReader(make([]byte, 1025)))), ShouldEqual, nil)
+			So(big.Data, ShouldBeNil)
+			So(big.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Writing moves the contents out into a chunk", func() {
+			_, err := primitive.WriteAt([]byte("moon"), 10)
+			So(err, ShouldEqual, nil)
+			So(primitive.Data, ShouldBeNil)
+			So(primitive.Append(bufio.NewReader(bytes.NewReader([]byte("\n"))), 1), ShouldEqual, nil)
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(string(got), ShouldEqual, `{"icon": "moon", "size": 16}`+"\n")
+		})
+		Convey("Clones and compositions of inline primitives", func() {
+			clone, err := primitive.Clone()
+			So(err, ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, nil)
+			composed := mode.Primitive{Name: "icons.json"}
+			So(composed.Compose([]string{clone.Id, clone.Id}), ShouldEqual, nil)
+			got, err := stream(composed.Id)
+			So(err, ShouldEqual, nil)
+			So(string(got), ShouldEqual, string(data)+string(data))
+			So(clone.Destroy(), ShouldEqual, nil)
+			So(composed.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Inline contents are compressed and encrypted like chunks", func() {
+			keys := &mode.MasterKeys{Current: "k", Keys: map[string][]byte{"k": bytes.Repeat([]byte{9}, 32)}}
+			So(mode.SetOptions(mode.Options{Inline: 1024, Compression: "gzip", Keys: keys}), ShouldEqual, nil)
+			secret := mode.Primitive{Name: "secret.json", Length: len(data)}
+			So(secret.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			So(bytes.Contains(secret.Data, []byte("star")), ShouldBeFalse)
+			got, err := stream(secret.Id)
+			So(err, ShouldEqual, nil)
+			So(string(got), ShouldEqual, string(data))
+			So(secret.Destroy(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			primitive.Destroy()
+		})
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	dir, err := ioutil.TempDir("", "lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive, err := mode.NewDirTier("archive", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode.RegisterTier(archive)
+	upload := func(name, mimeType string, days int, data []byte) *mode.Primitive {
+		created := time.Now().Add(-time.Duration(days) * 24 * time.Hour).UTC().Format(time.RFC3339)
+		p := &mode.Primitive{Name: name, MimeType: mimeType, Length: len(data), Created: created}
+		So(p.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+		return p
+	}
+	Convey("Testing lifecycle rules", t, func() {
+		text := bytes.Repeat([]byte("all work and no play "), 10000)
+		logs := upload("lifecycle/logs/2014.txt", "text/plain", 400, text)
+		notes := upload("lifecycle/notes.txt", "text/plain", 40, text)
+		video := upload("lifecycle/talk.mp4", "video/mp4", 40, text)
+		rules := []mode.Rule{
+			{Prefix: "lifecycle/logs/", Days: 365, Action: "expire"},
+			{Prefix: "lifecycle/", MimeType: "text/", Days: 30, Action: "compress", Codec: "gzip"},
+			{Prefix: "lifecycle/", MimeType: "video/mp4", Size: 1000, Action: "tier", Tier: "archive"},
+		}
+
+		Convey("A dry run reports the actions without taking them", func() {
+			actions, err := mode.RunLifecycle(rules, true)
+			So(err, ShouldEqual, nil)
+			So(len(actions), ShouldEqual, 3)
+			taken := map[string]mode.LifecycleAction{}
+			for _, action := range actions {
+				taken[action.Id] = action
+			}
+			So(taken[logs.Id], ShouldResemble, mode.LifecycleAction{Id: logs.Id, Name: logs.Name, Rule: 0, Action: "expire"})
+			So(taken[notes.Id], ShouldResemble, mode.LifecycleAction{Id: notes.Id, Name: notes.Name, Rule: 1, Action: "compress"})
+			So(taken[video.Id], ShouldResemble, mode.LifecycleAction{Id: video.Id, Name: video.Name, Rule: 2, Action: "tier"})
+			So(logs.Find(), ShouldEqual, nil)
+			So(notes.Find(), ShouldEqual, nil)
+			So(notes.Codec, ShouldEqual, "")
+		})
+		Convey("A run takes the actions", func() {
+			actions, err := mode.RunLifecycle(rules, false)
+			So(err, ShouldEqual, nil)
+			So(len(actions), ShouldEqual, 3)
+			So(logs.Find(), ShouldEqual, mode.NOT_FOUND)
+			So(notes.Find(), ShouldEqual, nil)
+			So(notes.Codec, ShouldEqual, "gzip")
+			got, err := stream(notes.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, text), ShouldBeTrue)
+			So(video.Find(), ShouldEqual, nil)
+			So(video.Tier, ShouldEqual, "archive")
+			got, err = stream(video.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, text), ShouldBeTrue)
+
+			actions, err = mode.RunLifecycle(rules, false)
+			So(err, ShouldEqual, nil)
+			So(len(actions), ShouldEqual, 0)
+		})
+		Convey("Rules with unknown actions are rejected", func() {
+			_, err := mode.RunLifecycle([]mode.Rule{{Action: "archive"}}, true)
+			So(err, ShouldNotEqual, nil)
+			_, err = mode.RunLifecycle([]mode.Rule{{Action: "tier", Tier: "glacier"}}, true)
+			So(err, ShouldNotEqual, nil)
+		})
+		Reset(func() {
+			logs.Destroy()
+			notes.Destroy()
+			video.Destroy()
+			mode.CollectTiers()
+		})
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+)
+
+func TestMultipart(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing multipart uploads", t, func() {
+		p := mode.Primitive{Name: "archive.tar", MimeType: "application/x-tar"}
+		upload, err := p.StartMultipart()
+		So(err, ShouldEqual, nil)
+
+		var parts [][]byte
+		for i, size := range []int{mode.CHUNK_SIZE + 99, 2 * mode.CHUNK_SIZE, 1000} {
+			parts = append(parts, bytes.Repeat([]byte{byte('a' + i)}, size))
+		}
+
+		Convey("Upload parts concurrently and complete them in order", func() {
+			var wg sync.WaitGroup
+			errs := make([]error, len(parts))
+			for i := range parts {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = upload.UploadPart(i+1, bufio.NewReader(bytes.NewReader(parts[i])), len(parts[i]))
+				}(i)
+			}
+			wg.Wait()
+			for i := range errs {
+				So(errs[i], ShouldEqual, nil)
+			}
+
+			listed, err := upload.ListParts()
+			So(err, ShouldEqual, nil)
+			So(len(listed), ShouldEqual, 3)
+			for i := range listed {
+				So(listed[i].Number, ShouldEqual, i+1)
+				So(listed[i].Length, ShouldEqual, len(parts[i]))
+				sum := md5.Sum(parts[i])
+				So(listed[i].Md5, ShouldEqual, hex.EncodeToString(sum[:]))
+			}
+
+			primitive, err := upload.Complete([]int{1, 2, 3})
+			So(err, ShouldEqual, nil)
+			expected := append(append(append([]byte{}, parts[0]...), parts[1]...), parts[2]...)
+			So(primitive.Id, ShouldEqual, upload.Id)
+			So(primitive.Length, ShouldEqual, len(expected))
+			var sums []byte
+			for i := range parts {
+				sum := md5.Sum(parts[i])
+				sums = append(sums, sum[:]...)
+			}
+			sum := md5.Sum(sums)
+			So(primitive.Md5, ShouldEqual, hex.EncodeToString(sum[:])+"-3")
+			So(primitive.Sha256, ShouldEndWith, "-3")
+			So(primitive.Rehash(), ShouldEqual, nil)
+			So(primitive.Md5, ShouldEqual, hex.EncodeToString(sum[:])+"-3")
+
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, expected), ShouldBeTrue)
+
+			_, err = upload.ListParts()
+			So(err, ShouldEqual, mode.UPLOAD_NOT_FOUND)
+			So(primitive.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Re-uploading a part replaces it and unlisted parts are discarded", func() {
+			for i := range parts {
+				_, err := upload.UploadPart(i+1, bufio.NewReader(bytes.NewReader(parts[i])), len(parts[i]))
+				So(err, ShouldEqual, nil)
+			}
+			_, err := upload.UploadPart(3, bufio.NewReader(bytes.NewReader([]byte("replaced"))), 8)
+			So(err, ShouldEqual, nil)
+
+			primitive, err := upload.Complete([]int{1, 3})
+			So(err, ShouldEqual, nil)
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, append(append([]byte{}, parts[0]...), []byte("replaced")...)), ShouldBeTrue)
+			So(primitive.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Completing with a missing or out of order part fails", func() {
+			_, err := upload.UploadPart(1, bufio.NewReader(bytes.NewReader(parts[0])), len(parts[0]))
+			So(err, ShouldEqual, nil)
+			_, err = upload.Complete([]int{1, 2})
+			So(err, ShouldEqual, mode.PART_NOT_FOUND)
+			_, err = upload.UploadPart(2, bufio.NewReader(bytes.NewReader(parts[1])), len(parts[1]))
+			So(err, ShouldEqual, nil)
+			_, err = upload.Complete([]int{2, 1})
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("A part of unknown length is refused", func() {
+			_, err := upload.UploadPart(1, bufio.NewReader(bytes.NewReader(parts[0])), -1)
+			So(err, ShouldEqual, mode.MISSING_ARG)
+			listed, err := upload.ListParts()
+			So(err, ShouldEqual, nil)
+			So(len(listed), ShouldEqual, 0)
+		})
+		Convey("Only those the primitive allows may use an upload", func() {
+			owned := mode.Primitive{Name: "private.tar", Actor: "alice",
+				ACL: []mode.Grant{{Principal: "group:editors", Write: true}}}
+			private, err := owned.StartMultipart()
+			So(err, ShouldEqual, nil)
+			mallory := mode.Multipart{Id: private.Id, Actor: "mallory"}
+			_, err = mallory.UploadPart(1, bufio.NewReader(bytes.NewReader(parts[2])), len(parts[2]))
+			So(err, ShouldEqual, mode.FORBIDDEN)
+			_, err = mallory.ListParts()
+			So(err, ShouldEqual, mode.FORBIDDEN)
+			_, err = mallory.Complete([]int{1})
+			So(err, ShouldEqual, mode.FORBIDDEN)
+			So(mallory.Abort(), ShouldEqual, mode.FORBIDDEN)
+
+			editor := mode.Multipart{Id: private.Id, Actor: "bob", Groups: []string{"editors"}}
+			_, err = editor.UploadPart(1, bufio.NewReader(bytes.NewReader(parts[2])), len(parts[2]))
+			So(err, ShouldEqual, nil)
+			listed, err := editor.ListParts()
+			So(err, ShouldEqual, nil)
+			So(len(listed), ShouldEqual, 1)
+			So(editor.Abort(), ShouldEqual, mode.FORBIDDEN)
+			So(private.Abort(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			upload.Abort()
+		})
+	})
+}
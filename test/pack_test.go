@@ -0,0 +1,119 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestPacking(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing packed primitives", t, func() {
+		So(mode.SetOptions(mode.Options{Pack: 100000}), ShouldEqual, nil)
+		var thumbnails []mode.Primitive
+		var contents [][]byte
+		for i := 0; i < 3; i++ {
+			data := bytes.Repeat([]byte(fmt.Sprintf("thumbnail %d ", i)), 100000/12)
+			p := mode.Primitive{Name: fmt.Sprintf("thumb-%d.png", i), Length: len(data)}
+			So(p.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			thumbnails = append(thumbnails, p)
+			contents = append(contents, data)
+		}
+
+		Convey("Small primitives share packs, filled up to PACK_SIZE", func() {
+			So(thumbnails[0].Pack, ShouldNotEqual, "")
+			So(thumbnails[1].Pack, ShouldEqual, thumbnails[0].Pack)
+			So(thumbnails[1].PackOff, ShouldEqual, thumbnails[0].PackLen)
+			So(thumbnails[2].Pack, ShouldNotEqual, thumbnails[0].Pack)
+			for i, p := range thumbnails {
+				got, err := stream(p.Id)
+				So(err, ShouldEqual, nil)
+				So(bytes.Equal(got, contents[i]), ShouldBeTrue)
+			}
+		})
+		Convey("Compaction rewrites packs that are mostly garbage", func() {
+			n, err := mode.CompactPacks(0.5)
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+
+			So(thumbnails[0].Destroy(), ShouldEqual, nil)
+			n, err = mode.CompactPacks(0.5)
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+
+			moved := mode.Primitive{Id: thumbnails[1].Id}
+			So(moved.Find(), ShouldEqual, nil)
+			So(moved.Pack, ShouldEqual, thumbnails[2].Pack)
+			got, err := stream(moved.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, contents[1]), ShouldBeTrue)
+		})
+		Convey("A pack left idle is no longer filled", func() {
+			idle := mode.PACK_IDLE
+			mode.PACK_IDLE = 0
+			n, err := mode.CompactPacks(0.5)
+			mode.PACK_IDLE = idle
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+
+			data := bytes.Repeat([]byte("icon "), 100)
+			p := mode.Primitive{Name: "icon.png", Length: len(data)}
+			So(p.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			So(p.Pack, ShouldNotEqual, "")
+			So(p.Pack, ShouldNotEqual, thumbnails[2].Pack)
+			So(p.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Clones share the packed contents, and writes move them out", func() {
+			clone, err := thumbnails[1].Clone()
+			So(err, ShouldEqual, nil)
+			So(clone.Pack, ShouldEqual, thumbnails[1].Pack)
+			_, err = thumbnails[1].WriteAt([]byte("THUMBNAIL"), 0)
+			So(err, ShouldEqual, nil)
+			So(thumbnails[1].Pack, ShouldEqual, "")
+
+			got, err := stream(clone.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, contents[1]), ShouldBeTrue)
+			got, err = stream(thumbnails[1].Id)
+			So(err, ShouldEqual, nil)
+			So(string(got[:11]), ShouldEqual, "THUMBNAIL 1")
+			So(clone.Destroy(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			for _, p := range thumbnails {
+				p.Destroy()
+			}
+		})
+	})
+}
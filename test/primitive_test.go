@@ -44,24 +44,24 @@ func TestPrimitive(t *testing.T) {
 	Convey("Testing Primitive", t, func() {
 
 		Convey("Set the meta data for a non-existent Primitive", func() {
-			primitive := mode.Primitive{"e64a919ef57c4481bcd5fba43f8efb9c", "sample.jpg", 4, 5, 6, "one", "two", "image/jpg"}
+			primitive := mode.Primitive{Id: "e64a919ef57c4481bcd5fba43f8efb9c", Name: "sample.jpg", Length: 4, CSize: 5, Chunks: 6, Created: "one", Md5: "two", MimeType: "image/jpg"}
 			err := primitive.SetMeta()
 			So(err, ShouldEqual, nil)
 			//fmt.Println("Primitive.Meta after set:", primitive)
 			So(primitive.MimeType, ShouldEqual, "image/jpg")
 			Convey("Read the meta data for the same Primitive", func() {
-				primitive := mode.Primitive{"e64a919ef57c4481bcd5fba43f8efb9c", "", 0, 0, 0, "", "", ""}
+				primitive := mode.Primitive{Id: "e64a919ef57c4481bcd5fba43f8efb9c"}
 				err := primitive.Meta()
 				So(err, ShouldEqual, nil)
 				So(primitive.MimeType, ShouldEqual, "image/jpg")
 				So(primitive.Name, ShouldEqual, "sample.jpg")
 			})
 			Convey("Read the meta data for the same Primitive", func() {
-				primitive := mode.Primitive{"e64a919ef57c4481bcd5fba43f8efb9c", "", 0, 0, 0, "", "", ""}
+				primitive := mode.Primitive{Id: "e64a919ef57c4481bcd5fba43f8efb9c"}
 				err := primitive.DestroyMeta()
 				So(err, ShouldEqual, nil)
 				Convey("Meta data should not exist", func() {
-					primitive := mode.Primitive{"e64a919ef57c4481bcd5fba43f8efb9c", "", 0, 0, 0, "", "", ""}
+					primitive := mode.Primitive{Id: "e64a919ef57c4481bcd5fba43f8efb9c"}
 					err := primitive.Meta()
 					So(err, ShouldNotEqual, nil)
 					//fmt.Println("Primitive.Meta:", primitive)
@@ -96,7 +96,7 @@ func TestPrimitive(t *testing.T) {
 				if err != nil {
 					log.Fatal(err)
 				}
-				primitive := mode.Primitive{"", "", int(stat.Size()), 0, 0, "", "", ""}
+				primitive := mode.Primitive{Length: int(stat.Size())}
 				reader := bufio.NewReader(file)
 				primitive.Length = int(stat.Size())
 				err = primitive.Make(reader)
@@ -0,0 +1,128 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	kv := rawClient()
+	forgetCustodian := func() {
+		delReq := &proto.DeleteRequest{}
+		delReq.Key = proto.Key("primitive:custodian")
+		kv.Call(proto.Delete, delReq, &proto.DeleteResponse{})
+	}
+	Convey("Testing retention locks and legal holds", t, func() {
+		data := bytes.Repeat([]byte("ledger 2015 "), 20000)
+		primitive := mode.Primitive{Name: "ledger-2015.pdf", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("A retention lock refuses changes", func() {
+			So(primitive.Lock(time.Now().Add(24*time.Hour)), ShouldEqual, nil)
+			_, err := primitive.WriteAt([]byte("forged"), 0)
+			So(err, ShouldEqual, mode.LOCKED)
+			So(primitive.Truncate(10), ShouldEqual, mode.LOCKED)
+			So(primitive.Append(bufio.NewReader(bytes.NewReader(data[:10])), 10), ShouldEqual, mode.LOCKED)
+			primitive.Name = "renamed.pdf"
+			So(primitive.SetMeta(), ShouldEqual, mode.LOCKED)
+			So(primitive.Destroy(), ShouldEqual, mode.LOCKED)
+			So(primitive.Purge(), ShouldEqual, mode.LOCKED)
+			So((&mode.Primitive{Id: primitive.Id}).DestroyMeta(), ShouldEqual, mode.LOCKED)
+			So(mode.SetOptions(mode.Options{TrashDays: 30}), ShouldEqual, nil)
+			So(primitive.Destroy(), ShouldEqual, mode.LOCKED)
+
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+		})
+		Convey("A retention time can be extended but not brought forward", func() {
+			later := time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+			So(primitive.Lock(time.Now().Add(48*time.Hour)), ShouldEqual, nil)
+			So(primitive.Lock(time.Now().Add(time.Hour)), ShouldEqual, nil)
+			So(primitive.Find(), ShouldEqual, nil)
+			So(primitive.Retain, ShouldEqual, later)
+		})
+		Convey("A legal hold outlasts expiry", func() {
+			held := mode.Primitive{Name: "export.csv", Length: 100, Hold: true,
+				Expires: time.Now().Add(-time.Minute).Format(time.RFC3339)}
+			So(held.Make(bufio.NewReader(bytes.NewReader(data[:100]))), ShouldEqual, nil)
+			So(mode.SetCustodian("", "records-office"), ShouldEqual, nil)
+			n, err := mode.SweepExpired()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+			So((&mode.Primitive{Id: held.Id}).Find(), ShouldEqual, nil)
+			So(held.Release("records-office"), ShouldEqual, nil)
+			So((&mode.Primitive{Id: held.Id}).Find(), ShouldEqual, mode.NOT_FOUND)
+			n, err = mode.SweepExpired()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+		})
+		Convey("Only the custodian releases a lock", func() {
+			So(primitive.PlaceHold(), ShouldEqual, nil)
+			So(primitive.Lock(time.Now().Add(24*time.Hour)), ShouldEqual, nil)
+			So(primitive.Release(""), ShouldEqual, mode.FORBIDDEN)
+			So(mode.SetCustodian("", "records-office"), ShouldEqual, nil)
+			So(primitive.Release("guess"), ShouldEqual, mode.FORBIDDEN)
+			So(mode.SetCustodian("guess", "mine now"), ShouldEqual, mode.FORBIDDEN)
+			So(primitive.Release("records-office"), ShouldEqual, nil)
+			So(primitive.Hold, ShouldBeFalse)
+			So(primitive.Retain, ShouldEqual, "")
+			_, err := primitive.WriteAt([]byte("amended"), 0)
+			So(err, ShouldEqual, nil)
+
+			So(mode.SetCustodian("records-office", "archives"), ShouldEqual, nil)
+			So(primitive.PlaceHold(), ShouldEqual, nil)
+			So(primitive.Release("records-office"), ShouldEqual, mode.FORBIDDEN)
+			So(primitive.Release("archives"), ShouldEqual, nil)
+		})
+		Convey("Primitives can be made locked", func() {
+			locked := mode.Primitive{Name: "minutes.pdf", Length: 100, Retain: time.Now().Add(time.Hour).Format(time.RFC3339)}
+			So(locked.Make(bufio.NewReader(bytes.NewReader(data[:100]))), ShouldEqual, nil)
+			So(locked.Destroy(), ShouldEqual, mode.LOCKED)
+			So(mode.SetCustodian("", "records-office"), ShouldEqual, nil)
+			So(locked.Release("records-office"), ShouldEqual, nil)
+			So(locked.Destroy(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			forgetCustodian()
+			mode.SetCustodian("", "records-office")
+			primitive.Release("records-office")
+			primitive.Destroy()
+			forgetCustodian()
+		})
+	})
+}
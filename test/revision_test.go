@@ -0,0 +1,109 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRevisions(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing revisions", t, func() {
+		So(mode.SetOptions(mode.Options{Revisions: true}), ShouldEqual, nil)
+		original := bytes.Repeat([]byte("0123456789"), mode.CHUNK_SIZE/4)
+		primitive := mode.Primitive{Name: "revised.txt", Length: len(original)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(original))), ShouldEqual, nil)
+		_, err := primitive.WriteAt([]byte("first"), 0)
+		So(err, ShouldEqual, nil)
+		_, err = primitive.WriteAt([]byte("second"), 0)
+		So(err, ShouldEqual, nil)
+		So(primitive.Truncate(int64(mode.CHUNK_SIZE)), ShouldEqual, nil)
+		So(primitive.Revs, ShouldEqual, 3)
+
+		Convey("Each revision reads as the primitive was before it was changed", func() {
+			revisions, err := primitive.Revisions()
+			So(err, ShouldEqual, nil)
+			So(len(revisions), ShouldEqual, 3)
+			expected := [][]byte{
+				original,
+				append([]byte("first"), original[5:]...),
+				append([]byte("second"), original[6:]...),
+			}
+			for i := range revisions {
+				reader, err := revisions[i].Open()
+				So(err, ShouldEqual, nil)
+				got, err := ioutil.ReadAll(reader)
+				So(err, ShouldEqual, nil)
+				So(bytes.Equal(got, expected[i]), ShouldBeTrue)
+			}
+		})
+		Convey("Pruning keeps the newest revisions", func() {
+			pruned, err := primitive.PruneRevisions(1)
+			So(err, ShouldEqual, nil)
+			So(pruned, ShouldEqual, 2)
+			So(primitive.Revs, ShouldEqual, 1)
+			revisions, err := primitive.Revisions()
+			So(err, ShouldEqual, nil)
+			So(len(revisions), ShouldEqual, 1)
+			reader, err := revisions[0].Open()
+			So(err, ShouldEqual, nil)
+			got, err := ioutil.ReadAll(reader)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, append([]byte("second"), original[6:]...)), ShouldBeTrue)
+
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			reader, err = readPrimitive.Open()
+			So(err, ShouldEqual, nil)
+			got, err = ioutil.ReadAll(reader)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, append([]byte("second"), original[6:mode.CHUNK_SIZE]...)), ShouldBeTrue)
+		})
+		Convey("A lifecycle rule prunes revisions", func() {
+			rules := []mode.Rule{{Prefix: "revised", Action: "prune", Keep: 2}}
+			actions, err := mode.RunLifecycle(rules, false)
+			So(err, ShouldEqual, nil)
+			So(actions, ShouldResemble, []mode.LifecycleAction{{Id: primitive.Id, Name: primitive.Name, Rule: 0, Action: "prune"}})
+			revisions, err := primitive.Revisions()
+			So(err, ShouldEqual, nil)
+			So(len(revisions), ShouldEqual, 2)
+
+			actions, err = mode.RunLifecycle(rules, false)
+			So(err, ShouldEqual, nil)
+			So(len(actions), ShouldEqual, 0)
+		})
+		Reset(func() {
+			primitive.Destroy()
+			mode.SetOptions(mode.Options{})
+		})
+	})
+}
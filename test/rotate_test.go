@@ -0,0 +1,112 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestRotation(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing master key rotation", t, func() {
+		old, current := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+		So(mode.SetOptions(mode.Options{Keys: &mode.MasterKeys{Current: "2015", Keys: map[string][]byte{"2015": old}}}), ShouldEqual, nil)
+		data := bytes.Repeat([]byte("rotate me "), mode.CHUNK_SIZE/4)
+		primitive := mode.Primitive{Name: "keys.txt", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+		clone, err := primitive.Clone()
+		So(err, ShouldEqual, nil)
+		session, err := (&mode.Primitive{Name: "pending.txt"}).StartSession()
+		So(err, ShouldEqual, nil)
+		So(session.Write(bufio.NewReader(bytes.NewReader([]byte("pending"))), 0, 7), ShouldEqual, nil)
+
+		rotated := &mode.MasterKeys{Current: "2016", Keys: map[string][]byte{"2015": old, "2016": current}}
+		retired := &mode.MasterKeys{Current: "2016", Keys: map[string][]byte{"2016": current}}
+		So(mode.SetOptions(mode.Options{Keys: rotated}), ShouldEqual, nil)
+
+		Convey("Re-wrapping moves every data key to the current master key", func() {
+			job, err := mode.RotateKeys(false)
+			So(err, ShouldEqual, nil)
+			So(job.KeyId, ShouldEqual, "2016")
+			So(job.Rewrapped, ShouldBeGreaterThanOrEqualTo, 3)
+			So(job.Reencrypted, ShouldEqual, 0)
+
+			So(mode.SetOptions(mode.Options{Keys: retired}), ShouldEqual, nil)
+			for _, id := range []string{primitive.Id, clone.Id} {
+				readPrimitive := mode.Primitive{Id: id}
+				So(readPrimitive.Find(), ShouldEqual, nil)
+				So(readPrimitive.KeyId, ShouldEqual, "2016")
+				got, err := stream(id)
+				So(err, ShouldEqual, nil)
+				So(bytes.Equal(got, data), ShouldBeTrue)
+			}
+			finished, err := session.Finalize()
+			So(err, ShouldEqual, nil)
+			got, err := stream(finished.Id)
+			So(err, ShouldEqual, nil)
+			So(string(got), ShouldEqual, "pending")
+			So(finished.Destroy(), ShouldEqual, nil)
+
+			Convey("A second run finds nothing left to do", func() {
+				job, err := mode.RotateKeys(false)
+				So(err, ShouldEqual, nil)
+				So(job.Rewrapped, ShouldEqual, 0)
+			})
+		})
+		Convey("Full rotation re-encrypts under new data keys", func() {
+			before := mode.Primitive{Id: primitive.Id}
+			So(before.Find(), ShouldEqual, nil)
+			job, err := mode.RotateKeys(true)
+			So(err, ShouldEqual, nil)
+			So(job.Reencrypted, ShouldBeGreaterThanOrEqualTo, 2)
+
+			So(mode.SetOptions(mode.Options{Keys: retired}), ShouldEqual, nil)
+			after := mode.Primitive{Id: primitive.Id}
+			So(after.Find(), ShouldEqual, nil)
+			So(after.KeyId, ShouldEqual, "2016")
+			So(after.Md5, ShouldEqual, before.Md5)
+			for _, id := range []string{primitive.Id, clone.Id} {
+				got, err := stream(id)
+				So(err, ShouldEqual, nil)
+				So(bytes.Equal(got, data), ShouldBeTrue)
+			}
+			So(session.Abort(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{Keys: rotated})
+			session.Abort()
+			primitive.Destroy()
+			clone.Destroy()
+			mode.SetOptions(mode.Options{})
+		})
+	})
+}
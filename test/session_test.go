@@ -0,0 +1,126 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing upload sessions", t, func() {
+		data := bytes.Repeat([]byte("media"), mode.CHUNK_SIZE/2)
+		p := mode.Primitive{Name: "video.mp4", MimeType: "video/mp4", Length: len(data)}
+		session, err := p.StartSession()
+		So(err, ShouldEqual, nil)
+		So(session.Offset(), ShouldEqual, 0)
+
+		Convey("Write the upload in pieces and finalize it", func() {
+			cut := mode.CHUNK_SIZE + 1234
+			err := session.Write(bufio.NewReader(bytes.NewReader(data[:cut])), 0, cut)
+			So(err, ShouldEqual, nil)
+
+			// a second process picks the session up by id
+			resumed := mode.Session{Id: session.Id}
+			So(resumed.Find(), ShouldEqual, nil)
+			So(resumed.Offset(), ShouldEqual, cut)
+			err = resumed.Write(bufio.NewReader(bytes.NewReader(data[cut:])), cut, len(data)-cut)
+			So(err, ShouldEqual, nil)
+
+			primitive, err := resumed.Finalize()
+			So(err, ShouldEqual, nil)
+			So(primitive.Id, ShouldEqual, session.Id)
+			So(primitive.Length, ShouldEqual, len(data))
+			So(primitive.Name, ShouldEqual, "video.mp4")
+			sum := md5.Sum(data)
+			So(primitive.Md5, ShouldEqual, hex.EncodeToString(sum[:]))
+
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			So(session.Find(), ShouldEqual, mode.SESSION_NOT_FOUND)
+			So(primitive.Destroy(), ShouldEqual, nil)
+		})
+		Convey("A write at the wrong offset is refused", func() {
+			err := session.Write(bufio.NewReader(bytes.NewReader(data[:100])), 0, 100)
+			So(err, ShouldEqual, nil)
+			err = session.Write(bufio.NewReader(bytes.NewReader(data[:100])), 0, 100)
+			So(err, ShouldEqual, mode.WRONG_OFFSET)
+			So(session.Offset(), ShouldEqual, 100)
+			err = session.Write(bufio.NewReader(bytes.NewReader(data[:100])), 100, -1)
+			So(err, ShouldEqual, mode.MISSING_ARG)
+			So(session.Offset(), ShouldEqual, 100)
+		})
+		Convey("A session can't be finalized before all bytes arrive", func() {
+			err := session.Write(bufio.NewReader(bytes.NewReader(data[:100])), 0, 100)
+			So(err, ShouldEqual, nil)
+			_, err = session.Finalize()
+			So(err, ShouldNotEqual, nil)
+		})
+		Convey("Only those the primitive allows may use a session", func() {
+			owned := mode.Primitive{Name: "private.mp4", Length: 100, Actor: "alice",
+				ACL: []mode.Grant{{Principal: "group:editors", Write: true}}}
+			private, err := owned.StartSession()
+			So(err, ShouldEqual, nil)
+			mallory := mode.Session{Id: private.Id, Actor: "mallory"}
+			So(mallory.Find(), ShouldEqual, mode.FORBIDDEN)
+			So(mallory.Write(bufio.NewReader(bytes.NewReader(data[:100])), 0, 100), ShouldEqual, mode.FORBIDDEN)
+			_, err = mallory.Finalize()
+			So(err, ShouldEqual, mode.FORBIDDEN)
+			So(mallory.Abort(), ShouldEqual, mode.FORBIDDEN)
+
+			editor := mode.Session{Id: private.Id, Actor: "bob", Groups: []string{"editors"}}
+			So(editor.Find(), ShouldEqual, nil)
+			So(editor.Write(bufio.NewReader(bytes.NewReader(data[:100])), 0, 100), ShouldEqual, nil)
+			So(editor.Abort(), ShouldEqual, mode.FORBIDDEN)
+			So(private.Abort(), ShouldEqual, nil)
+		})
+		Convey("Abandoned sessions are collected", func() {
+			ttl := mode.SESSION_TTL
+			mode.SESSION_TTL = -time.Second
+			err := session.Write(bufio.NewReader(bytes.NewReader(data[:100])), 0, 100)
+			mode.SESSION_TTL = ttl
+			So(err, ShouldEqual, nil)
+
+			n, err := mode.CollectSessions()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldBeGreaterThanOrEqualTo, 1)
+			So(session.Find(), ShouldEqual, mode.SESSION_NOT_FOUND)
+		})
+		Reset(func() {
+			session.Abort()
+		})
+	})
+}
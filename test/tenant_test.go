@@ -0,0 +1,176 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTenant(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	kv := rawClient()
+	// read streams the primitive with id from the named tenant
+	read := func(tenant, id string) ([]byte, error) {
+		p := mode.Primitive{Id: id, Tenant: tenant}
+		var out bytes.Buffer
+		w := bufio.NewWriter(&out)
+		err := p.Stream(w)
+		w.Flush()
+		return out.Bytes(), err
+	}
+	Convey("Testing tenants", t, func() {
+		So(mode.SetOptions(mode.Options{}), ShouldEqual, nil)
+		photos, err := mode.RegisterTenant("photos", mode.Options{ChunkSize: 100000, Compression: "gzip"})
+		So(err, ShouldEqual, nil)
+		keys := &mode.MasterKeys{Current: "2015", Keys: map[string][]byte{"2015": bytes.Repeat([]byte{7}, 32)}}
+		_, err = mode.RegisterTenant("vault", mode.Options{Keys: keys})
+		So(err, ShouldEqual, nil)
+
+		data := bytes.Repeat([]byte("pixel "), 50000)
+		primitive := mode.Primitive{Name: "beach.raw", Length: len(data), Tenant: "photos"}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("A tenant stores primitives with its own options", func() {
+			So(primitive.CSize, ShouldEqual, 100000)
+			So(primitive.Chunks, ShouldEqual, 3)
+			So(primitive.Codec, ShouldEqual, "gzip")
+			b, err := read("photos", primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(b, data), ShouldBeTrue)
+
+			getResp := &proto.GetResponse{}
+			So(kv.Call(proto.Get, proto.GetArgs(proto.Key("tenant:photos:meta:"+primitive.Id)), getResp), ShouldEqual, nil)
+			So(getResp.Value, ShouldNotEqual, nil)
+
+			secret := mode.Primitive{Name: "ledger.csv", Length: len(data), Tenant: "vault"}
+			So(secret.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			So(secret.Cipher, ShouldEqual, mode.CIPHER)
+			So(secret.CSize, ShouldEqual, mode.CHUNK_SIZE)
+			b, err = read("vault", secret.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(b, data), ShouldBeTrue)
+			So((&mode.Primitive{Id: secret.Id, Tenant: "vault"}).Destroy(), ShouldEqual, nil)
+
+			plain := mode.Primitive{Name: "notes.txt", Length: len(data)}
+			So(plain.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			So(plain.Cipher, ShouldEqual, "")
+			So(plain.Codec, ShouldEqual, "")
+			So(plain.Destroy(), ShouldEqual, nil)
+		})
+		Convey("An id doesn't resolve in another tenant", func() {
+			for _, tenant := range []string{"", "vault", "ghost", "photos:meta"} {
+				_, err := read(tenant, primitive.Id)
+				So(err, ShouldEqual, mode.NOT_FOUND)
+				So((&mode.Primitive{Id: primitive.Id, Tenant: tenant}).Find(), ShouldEqual, mode.NOT_FOUND)
+				So((&mode.Primitive{Id: primitive.Id, Tenant: tenant}).Destroy(), ShouldEqual, mode.NOT_FOUND)
+			}
+			found, err := photos.List("", 10)
+			So(err, ShouldEqual, nil)
+			So(len(found), ShouldEqual, 1)
+			So(found[0].Id, ShouldEqual, primitive.Id)
+			found, err = mode.List("", 1000)
+			So(err, ShouldEqual, nil)
+			for _, p := range found {
+				So(p.Id, ShouldNotEqual, primitive.Id)
+			}
+			_, err = read("photos", primitive.Id)
+			So(err, ShouldEqual, nil)
+		})
+		Convey("Tenants keep their chunks apart in a shared tier", func() {
+			dir, err := ioutil.TempDir("", "tenant")
+			So(err, ShouldEqual, nil)
+			defer os.RemoveAll(dir)
+			shared, err := mode.NewDirTier("shared", dir)
+			So(err, ShouldEqual, nil)
+			mode.RegisterTier(shared)
+			vault, err := mode.RegisterTenant("vault", mode.Options{Keys: keys, Tier: "shared"})
+			So(err, ShouldEqual, nil)
+			So(mode.SetOptions(mode.Options{Tier: "shared"}), ShouldEqual, nil)
+
+			secret := mode.Primitive{Name: "ledger.csv", Length: len(data), Tenant: "vault"}
+			So(secret.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			plain := mode.Primitive{Name: "notes.txt", Length: len(data)}
+			So(plain.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+			files, err := ioutil.ReadDir(dir)
+			So(err, ShouldEqual, nil)
+			var vaulted int
+			for _, f := range files {
+				if strings.HasPrefix(f.Name(), "tenant-vault-"+secret.Id) {
+					vaulted = vaulted + 1
+				} else {
+					So(f.Name(), ShouldStartWith, plain.Id)
+				}
+			}
+			So(vaulted, ShouldEqual, secret.Chunks)
+			b, err := read("vault", secret.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(b, data), ShouldBeTrue)
+
+			So(secret.Destroy(), ShouldEqual, nil)
+			So(plain.Destroy(), ShouldEqual, nil)
+			_, err = vault.CollectTiers()
+			So(err, ShouldEqual, nil)
+			_, err = mode.CollectTiers()
+			So(err, ShouldEqual, nil)
+			files, err = ioutil.ReadDir(dir)
+			So(err, ShouldEqual, nil)
+			So(len(files), ShouldEqual, 0)
+			So(mode.SetOptions(mode.Options{}), ShouldEqual, nil)
+		})
+		Convey("Nothing is made in a tenant that isn't registered", func() {
+			ghost := mode.Primitive{Name: "boo.txt", Length: len(data), Tenant: "ghost"}
+			So(ghost.Make(bufio.NewReader(bytes.NewReader(data))), ShouldNotEqual, nil)
+			_, err := mode.LookupTenant("ghost")
+			So(err, ShouldNotEqual, nil)
+			_, err = mode.RegisterTenant("photos:meta", mode.Options{})
+			So(err, ShouldNotEqual, nil)
+			_, err = mode.RegisterTenant("bad", mode.Options{ChunkSize: -1})
+			So(err, ShouldNotEqual, nil)
+			names := []string{}
+			for _, tenant := range mode.Tenants() {
+				names = append(names, tenant.Name)
+			}
+			So(names, ShouldResemble, []string{"", "photos", "vault"})
+		})
+		Reset(func() {
+			(&mode.Primitive{Id: primitive.Id, Tenant: "photos"}).Destroy()
+			delReq := &proto.DeleteRangeRequest{}
+			delReq.Key = proto.Key("tenant:")
+			delReq.EndKey = delReq.Key.PrefixEnd()
+			kv.Call(proto.DeleteRange, delReq, &proto.DeleteRangeResponse{})
+		})
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestTier(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	kv := rawClient()
+	dir, err := ioutil.TempDir("", "tier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cold, err := mode.NewDirTier("cold", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode.RegisterTier(cold)
+	files := func() int {
+		infos, err := ioutil.ReadDir(dir)
+		So(err, ShouldEqual, nil)
+		return len(infos)
+	}
+	Convey("Testing tiered primitives", t, func() {
+		So(mode.SetOptions(mode.Options{Tier: "cold", TierOver: mode.CHUNK_SIZE}), ShouldEqual, nil)
+		data := make([]byte, mode.CHUNK_SIZE*2+mode.CHUNK_SIZE/2)
+		rand.New(rand.NewSource(41)).Read(data)
+		primitive := mode.Primitive{Name: "lecture-01.mp4", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("Chunks are kept in the tier and read from it", func() {
+			So(primitive.Tier, ShouldEqual, "cold")
+			So(files(), ShouldEqual, 3)
+			getResp := &proto.GetResponse{}
+			So(kv.Call(proto.Get, proto.GetArgs(chunkKey(primitive.Id, 0)), getResp), ShouldEqual, nil)
+			So(getResp.Value, ShouldBeNil)
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+		})
+		Convey("Primitives under the threshold stay in cockroach", func() {
+			small := mode.Primitive{Name: "poster.png", Length: 1000}
+			So(small.Make(bufio.NewReader(bytes.NewReader(data[:1000]))), ShouldEqual, nil)
+			So(small.Tier, ShouldEqual, "")
+			So(files(), ShouldEqual, 3)
+			So(small.Destroy(), ShouldEqual, nil)
+		})
+		Convey("Released chunks are deleted from the tier once collected", func() {
+			_, err := primitive.WriteAt([]byte("intermission"), 10)
+			So(err, ShouldEqual, nil)
+			copy(data[10:], []byte("intermission"))
+			So(files(), ShouldEqual, 4)
+			n, err := mode.CollectTiers()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			So(files(), ShouldEqual, 3)
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+		})
+		Convey("Clones keep shared chunks in the tier", func() {
+			clone, err := primitive.Clone()
+			So(err, ShouldEqual, nil)
+			So(clone.Tier, ShouldEqual, "cold")
+			So(primitive.Destroy(), ShouldEqual, nil)
+			n, err := mode.CollectTiers()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+			got, err := stream(clone.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			So(clone.Destroy(), ShouldEqual, nil)
+		})
+		Convey("MoveTier moves the chunks back into cockroach", func() {
+			So(primitive.MoveTier(""), ShouldEqual, nil)
+			So(primitive.Tier, ShouldEqual, "")
+			n, err := mode.CollectTiers()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 3)
+			So(files(), ShouldEqual, 0)
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			So(primitive.MoveTier("cold"), ShouldEqual, nil)
+			So(files(), ShouldEqual, 3)
+			So(primitive.MoveTier("glacier"), ShouldNotEqual, nil)
+		})
+		Convey("Unknown tiers and deduplication are rejected", func() {
+			So(mode.SetOptions(mode.Options{Tier: "glacier"}), ShouldNotEqual, nil)
+			So(mode.SetOptions(mode.Options{Tier: "cold", Dedup: true}), ShouldNotEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			primitive.Destroy()
+			mode.CollectTiers()
+		})
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	listed := func(ps []*mode.Primitive, id string) bool {
+		for _, p := range ps {
+			if p.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+	Convey("Testing the trash", t, func() {
+		So(mode.SetOptions(mode.Options{TrashDays: 30}), ShouldEqual, nil)
+		data := bytes.Repeat([]byte("thesis draft "), 30000)
+		primitive := mode.Primitive{Name: "thesis.doc", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+		So(primitive.Destroy(), ShouldEqual, nil)
+
+		Convey("Destroy hides the primitive in the trash", func() {
+			So((&mode.Primitive{Id: primitive.Id}).Find(), ShouldEqual, mode.NOT_FOUND)
+			_, err := stream(primitive.Id)
+			So(err, ShouldEqual, mode.NOT_FOUND)
+			all, err := mode.List("", 1000)
+			So(err, ShouldEqual, nil)
+			So(listed(all, primitive.Id), ShouldBeFalse)
+			trash, err := mode.ListTrash("", 1000)
+			So(err, ShouldEqual, nil)
+			So(listed(trash, primitive.Id), ShouldBeTrue)
+		})
+		Convey("Restore brings it back", func() {
+			restored := mode.Primitive{Id: primitive.Id}
+			So(restored.Restore(), ShouldEqual, nil)
+			So(restored.Trashed, ShouldEqual, "")
+			got, err := stream(primitive.Id)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			all, err := mode.List("", 1000)
+			So(err, ShouldEqual, nil)
+			So(listed(all, primitive.Id), ShouldBeTrue)
+			So(restored.Restore(), ShouldEqual, mode.NOT_FOUND)
+		})
+		Convey("The trash is purged once the window has passed", func() {
+			n, err := mode.PurgeTrash()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+
+			old := mode.Primitive{Id: primitive.Id}
+			So(old.Restore(), ShouldEqual, nil)
+			old.Trashed = time.Now().Add(-31 * 24 * time.Hour).UTC().Format(time.RFC3339)
+			So(old.SetMeta(), ShouldEqual, nil)
+			n, err = mode.PurgeTrash()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			So((&mode.Primitive{Id: primitive.Id}).Restore(), ShouldEqual, mode.NOT_FOUND)
+		})
+		Convey("Purge destroys it at once", func() {
+			So((&mode.Primitive{Id: primitive.Id}).Purge(), ShouldEqual, nil)
+			trash, err := mode.ListTrash("", 1000)
+			So(err, ShouldEqual, nil)
+			So(listed(trash, primitive.Id), ShouldBeFalse)
+		})
+		Convey("List pages through primitives in id order", func() {
+			other := mode.Primitive{Name: "notes.txt", Length: 100}
+			So(other.Make(bufio.NewReader(bytes.NewReader(data[:100]))), ShouldEqual, nil)
+			first, err := mode.List("", 1)
+			So(err, ShouldEqual, nil)
+			So(len(first), ShouldEqual, 1)
+			rest, err := mode.List(first[0].Id, 1000)
+			So(err, ShouldEqual, nil)
+			So(listed(rest, first[0].Id), ShouldBeFalse)
+			So(listed(append(first, rest...), other.Id), ShouldBeTrue)
+			So(other.Purge(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			mode.SetOptions(mode.Options{})
+			(&mode.Primitive{Id: primitive.Id}).Purge()
+		})
+	})
+}
@@ -0,0 +1,245 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	kv := rawClient()
+	// receiver keeps the events posted to it and fails the first fail
+	// requests
+	var lock sync.Mutex
+	var received []mode.Event
+	var fail int
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Roachclip-Signature") != mode.Sign("s3cret", body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if fail > 0 {
+			fail = fail - 1
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		var e mode.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("X-Roachclip-Event") != e.Type {
+			http.Error(w, "wrong event", http.StatusBadRequest)
+			return
+		}
+		received = append(received, e)
+	}))
+	defer receiver.Close()
+	last := func() int64 {
+		events, err := mode.ReadEvents(0, 1000)
+		So(err, ShouldEqual, nil)
+		if len(events) == 0 {
+			return 0
+		}
+		return events[len(events)-1].Seq
+	}
+	// deliver delivers until the retries of the hook, a millisecond apart
+	// and after, are sure to be due
+	deliver := func(hook *mode.Webhook) int {
+		var delivered int
+		for i := 0; i < 5; i++ {
+			n, err := hook.Deliver()
+			So(err, ShouldEqual, nil)
+			delivered = delivered + n
+			time.Sleep(10 * time.Millisecond)
+		}
+		return delivered
+	}
+	Convey("Testing webhooks", t, func() {
+		So(mode.SetOptions(mode.Options{Events: true}), ShouldEqual, nil)
+		lock.Lock()
+		received, fail = nil, 0
+		lock.Unlock()
+		hook := &mode.Webhook{Name: "test", URL: receiver.URL, Secret: "s3cret", Retries: 2, Backoff: time.Millisecond}
+		_, err := hook.Deliver()
+		So(err, ShouldEqual, nil)
+		data := bytes.Repeat([]byte("frame "), 50000)
+		primitive := mode.Primitive{Name: "clip.mov", MimeType: "video/quicktime", Length: len(data)}
+		So(primitive.Make(bufio.NewReader(bytes.NewReader(data))), ShouldEqual, nil)
+
+		Convey("Events are delivered signed, once", func() {
+			So(primitive.Destroy(), ShouldEqual, nil)
+			n, err := hook.Deliver()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 2)
+			n, err = hook.Deliver()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+			So(len(received), ShouldEqual, 2)
+			So(received[0].Type, ShouldEqual, "create")
+			So(received[0].Id, ShouldEqual, primitive.Id)
+			So(received[0].Name, ShouldEqual, "clip.mov")
+			So(received[1].Type, ShouldEqual, "delete")
+		})
+		Convey("Only the kinds asked for are delivered", func() {
+			So(primitive.Destroy(), ShouldEqual, nil)
+			hook.Types = []string{"delete"}
+			n, err := hook.Deliver()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			So(received[0].Type, ShouldEqual, "delete")
+		})
+		Convey("Failed requests are retried", func() {
+			fail = 2
+			n, err := hook.Deliver()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+			queued, err := hook.Queued()
+			So(err, ShouldEqual, nil)
+			So(len(queued), ShouldEqual, 1)
+			So(queued[0].Attempts, ShouldEqual, 1)
+
+			So(deliver(hook), ShouldEqual, 1)
+			queued, err = hook.Queued()
+			So(err, ShouldEqual, nil)
+			So(len(queued), ShouldEqual, 0)
+			letters, err := hook.DeadLetters()
+			So(err, ShouldEqual, nil)
+			So(len(letters), ShouldEqual, 0)
+		})
+		Convey("A failed event doesn't hold up the events after it", func() {
+			So(primitive.Destroy(), ShouldEqual, nil)
+			fail = 1
+			hook.Backoff = time.Hour
+			n, err := hook.Deliver()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			So(received[0].Type, ShouldEqual, "delete")
+
+			hook.Backoff = 0
+			n, err = hook.Deliver()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			So(received[1].Type, ShouldEqual, "create")
+		})
+		Convey("Events that can't be delivered are dead lettered", func() {
+			fail = 3
+			So(deliver(hook), ShouldEqual, 0)
+			So(len(received), ShouldEqual, 0)
+			queued, err := hook.Queued()
+			So(err, ShouldEqual, nil)
+			So(len(queued), ShouldEqual, 0)
+			letters, err := hook.DeadLetters()
+			So(err, ShouldEqual, nil)
+			So(len(letters), ShouldEqual, 1)
+			So(letters[0].Event.Id, ShouldEqual, primitive.Id)
+			So(letters[0].Attempts, ShouldEqual, 3)
+
+			n, err := hook.Redeliver()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 1)
+			So(received[0].Id, ShouldEqual, primitive.Id)
+			letters, err = hook.DeadLetters()
+			So(err, ShouldEqual, nil)
+			So(len(letters), ShouldEqual, 0)
+		})
+		Convey("A bad signature is refused", func() {
+			hook.Secret, hook.Retries = "guess", 0
+			n, err := hook.Deliver()
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 0)
+			letters, err := hook.DeadLetters()
+			So(err, ShouldEqual, nil)
+			So(len(letters), ShouldEqual, 1)
+			So(letters[0].Error, ShouldContainSubstring, "401")
+		})
+		Convey("A name must not contain the key separator", func() {
+			prefixed := &mode.Webhook{Name: "test:", URL: receiver.URL}
+			_, err := prefixed.Deliver()
+			So(err, ShouldNotEqual, nil)
+			_, err = prefixed.DeadLetters()
+			So(err, ShouldNotEqual, nil)
+			_, err = (&mode.Webhook{URL: receiver.URL}).Queued()
+			So(err, ShouldEqual, mode.MISSING_ARG)
+		})
+		Convey("Run delivers until stopped", func() {
+			stop := make(chan struct{})
+			done := make(chan error)
+			go func() { done <- hook.Run(10*time.Millisecond, stop) }()
+			clone, err := primitive.Clone()
+			So(err, ShouldEqual, nil)
+			deadline := time.Now().Add(time.Second)
+			for time.Now().Before(deadline) {
+				lock.Lock()
+				n := len(received)
+				lock.Unlock()
+				if n == 2 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			close(stop)
+			So(<-done, ShouldEqual, nil)
+			So(len(received), ShouldEqual, 2)
+			So(received[1].Id, ShouldEqual, clone.Id)
+			So(clone.Destroy(), ShouldEqual, nil)
+		})
+		Reset(func() {
+			primitive.Destroy()
+			mode.SetOptions(mode.Options{})
+			So(mode.TrimEvents(last()), ShouldEqual, nil)
+			delReq := &proto.DeleteRequest{}
+			delReq.Key = proto.Key("primitive:eventSeq")
+			kv.Call(proto.Delete, delReq, &proto.DeleteResponse{})
+			delReq = &proto.DeleteRequest{}
+			delReq.Key = proto.Key("primitive:webhook:test")
+			kv.Call(proto.Delete, delReq, &proto.DeleteResponse{})
+			for _, prefix := range []string{"primitive:deadletter:test:", "primitive:retry:test:"} {
+				delRange := &proto.DeleteRangeRequest{}
+				delRange.Key = proto.Key(prefix)
+				delRange.EndKey = delRange.Key.PrefixEnd()
+				kv.Call(proto.DeleteRange, delRange, &proto.DeleteRangeResponse{})
+			}
+		})
+	})
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 CloudMoDe, LLC.
+//
+// The MIT License (MIT)
+
+// Copyright (c) 2015 cloudmode
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//
+//
+// Author: Michael McFall (mike@cloudmo.de)
+
+package mode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/roachclip-fs/mode"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	mode.OpenRoach("192.168.0.2", 8080)
+	defer mode.CloseRoach()
+	Convey("Testing Primitive.WriteAt and Primitive.Truncate", t, func() {
+		original := bytes.Repeat([]byte("0123456789"), mode.CHUNK_SIZE/4)
+		primitive := mode.Primitive{Name: "document.txt", Length: len(original)}
+		err := primitive.Make(bufio.NewReader(bytes.NewReader(original)))
+		So(err, ShouldEqual, nil)
+		So(primitive.Chunks, ShouldEqual, 3)
+
+		Convey("Overwrite a range that spans two chunks", func() {
+			patch := bytes.Repeat([]byte("x"), 1000)
+			off := mode.CHUNK_SIZE - 500
+			n, err := primitive.WriteAt(patch, int64(off))
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, len(patch))
+			So(primitive.Length, ShouldEqual, len(original))
+
+			expected := append([]byte{}, original...)
+			copy(expected[off:], patch)
+			So(primitive.Md5, ShouldEqual, "")
+			So(primitive.Sha256, ShouldEqual, "")
+			So(primitive.Rehash(), ShouldEqual, nil)
+			sum := md5.Sum(expected)
+			So(primitive.Md5, ShouldEqual, hex.EncodeToString(sum[:]))
+
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			reader, err := readPrimitive.Open()
+			So(err, ShouldEqual, nil)
+			got, err := ioutil.ReadAll(reader)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(got, expected), ShouldBeTrue)
+		})
+		Convey("Write past the end grows the primitive with zeros", func() {
+			off := len(original) + 10
+			_, err := primitive.WriteAt([]byte("tail"), int64(off))
+			So(err, ShouldEqual, nil)
+			So(primitive.Length, ShouldEqual, off+4)
+
+			reader, err := primitive.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 14)
+			n, err := reader.ReadAt(buf, int64(len(original)))
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 14)
+			So(string(buf), ShouldEqual, "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00tail")
+		})
+		Convey("Truncate to the middle of a chunk", func() {
+			size := mode.CHUNK_SIZE + 17
+			err := primitive.Truncate(int64(size))
+			So(err, ShouldEqual, nil)
+			So(primitive.Length, ShouldEqual, size)
+			So(primitive.Chunks, ShouldEqual, 2)
+
+			var out bytes.Buffer
+			writer := bufio.NewWriter(&out)
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			So(readPrimitive.Stream(writer), ShouldEqual, nil)
+			writer.Flush()
+			So(bytes.Equal(out.Bytes(), original[:size]), ShouldBeTrue)
+		})
+		Convey("A reader opened before a write does not see the new bytes", func() {
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			reader, err := readPrimitive.Open()
+			So(err, ShouldEqual, nil)
+			_, err = primitive.WriteAt([]byte("changed"), 0)
+			So(err, ShouldEqual, nil)
+
+			buf := make([]byte, 7)
+			_, err = reader.ReadAt(buf, 0)
+			So(err, ShouldEqual, mode.CHANGED)
+
+			_, err = reader.Seek(int64(mode.CHUNK_SIZE), 0)
+			So(err, ShouldEqual, nil)
+			n, err := io.ReadFull(reader, buf)
+			So(err, ShouldEqual, nil)
+			So(n, ShouldEqual, 7)
+			So(bytes.Equal(buf, original[mode.CHUNK_SIZE:mode.CHUNK_SIZE+7]), ShouldBeTrue)
+		})
+		Convey("A reader keeps the chunk it last read", func() {
+			reader, err := primitive.Open()
+			So(err, ShouldEqual, nil)
+			buf := make([]byte, 10)
+			_, err = reader.ReadAt(buf, 0)
+			So(err, ShouldEqual, nil)
+			_, err = primitive.WriteAt([]byte("changed"), 0)
+			So(err, ShouldEqual, nil)
+
+			_, err = reader.ReadAt(buf, 10)
+			So(err, ShouldEqual, nil)
+			So(bytes.Equal(buf, original[10:20]), ShouldBeTrue)
+		})
+		Convey("Meta data read before a write doesn't undo the write", func() {
+			stale := mode.Primitive{Id: primitive.Id}
+			So(stale.Meta(), ShouldEqual, nil)
+			_, err := primitive.WriteAt([]byte("changed"), 0)
+			So(err, ShouldEqual, nil)
+			So(primitive.Truncate(int64(mode.CHUNK_SIZE+17)), ShouldEqual, nil)
+
+			stale.MimeType = "text/plain"
+			So(stale.SetMeta(), ShouldEqual, nil)
+			So(stale.Length, ShouldEqual, mode.CHUNK_SIZE+17)
+
+			expected := append([]byte("changed"), original[7:mode.CHUNK_SIZE+17]...)
+			var out bytes.Buffer
+			writer := bufio.NewWriter(&out)
+			readPrimitive := mode.Primitive{Id: primitive.Id}
+			So(readPrimitive.Stream(writer), ShouldEqual, nil)
+			writer.Flush()
+			So(bytes.Equal(out.Bytes(), expected), ShouldBeTrue)
+			So(readPrimitive.MimeType, ShouldEqual, "text/plain")
+
+			_, err = primitive.WriteAt([]byte("again"), 0)
+			So(err, ShouldEqual, nil)
+			reader, err := readPrimitive.Open()
+			So(err, ShouldEqual, nil)
+			got, err := ioutil.ReadAll(reader)
+			So(err, ShouldEqual, nil)
+			So(string(got[:7]), ShouldEqual, "agained")
+		})
+		Reset(func() {
+			primitive.Destroy()
+		})
+	})
+}